@@ -9,6 +9,11 @@ package main
 
 import (
 	"context"
+	"fmt"
+	"os"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/ayashkov/k8srun/runner"
 	"github.com/ayashkov/k8srun/service"
@@ -25,10 +30,70 @@ func main() {
 
 func newRunCommand() *cobra.Command {
 	var kubeconfig string
+	var autoEnv []string
+	var gcOptions runner.GCOptions
+	var logLevel, logFormat, logFile string
 
 	job := runner.Job{
-		Instance: service.Os.Getenv("AUTOSERV"),
-		Name:     service.Os.Getenv("AUTO_JOB_NAME"),
+		Instance:  service.Os.Getenv("AUTOSERV"),
+		Name:      service.Os.Getenv("AUTO_JOB_NAME"),
+		RunNumber: service.Os.Getenv("AUTORUN"),
+	}
+	prepare := func(args []string) {
+		if job.Instance == "" || job.Name == "" {
+			service.Log.Fatal(
+				"both AUTOSERV and AUTO_JOB_NAME environment variables are required")
+		}
+
+		job.Template = args[0]
+		job.Args = args[1:]
+		job.Machine, _ = service.Os.Hostname()
+
+		for _, name := range autoEnv {
+			if !strings.HasPrefix(name, "AUTO") {
+				service.Log.Fatalf(
+					"only AutoSys variables can be passed, got %v", name)
+			}
+
+			if job.Env == nil {
+				job.Env = map[string]string{}
+			}
+
+			job.Env[name] = service.Os.Getenv(name)
+		}
+	}
+	closeLog := func() error { return nil }
+	exit := func(exitCode int, err error) {
+		if err != nil {
+			service.Log.Error(err)
+			exitCode = runner.ExitCode(err)
+		}
+
+		if err := closeLog(); err != nil {
+			service.Log.Warn(err)
+		}
+
+		service.Os.Exit(exitCode)
+	}
+	newRunner := func() runner.Runner {
+		jobRunner, err := runnerFactory.New(kubeconfig)
+
+		if err != nil {
+			exit(-1, err)
+		}
+
+		return jobRunner
+	}
+	run := func(cmd *cobra.Command, args []string) {
+		prepare(args)
+
+		jobRunner := newRunner()
+		ctx, stop := service.Os.NotifyContext(context.Background(),
+			os.Interrupt, syscall.SIGTERM)
+
+		defer stop()
+
+		exit(jobRunner.Run(ctx, &job, service.Os.Stdout()))
 	}
 	cmd := &cobra.Command{
 		Use:   "k8srun [flags] template [-- args ...]",
@@ -37,38 +102,206 @@ func newRunCommand() *cobra.Command {
 a Kubernetes cluster. The goal is to be able to
 execute Kubernetes workload from AutoSys jobs.`,
 		Args: cobra.MinimumNArgs(1),
-		Run: func(cmd *cobra.Command, args []string) {
-			if job.Instance == "" || job.Name == "" {
-				service.Log.Fatal(
-					"both AUTOSERV and AUTO_JOB_NAME environment variables are required")
-			}
-
-			job.Template = args[0]
-			job.Args = args[1:]
-
-			runner, err := runnerFactory.New(kubeconfig)
+		PersistentPreRun: func(cmd *cobra.Command, args []string) {
+			closeFile, err := service.ConfigureLog(logLevel, logFormat,
+				logFile)
 
 			if err != nil {
 				service.Log.Error(err)
-				service.Os.Exit(128)
+				service.Os.Exit(runner.EXIT_ERROR)
 			}
 
-			exitCode, err := runner.Run(context.Background(), &job,
-				service.Os.Stdout())
+			closeLog = closeFile
+		},
+		Run: run,
+	}
+
+	gc := &cobra.Command{
+		Use:   "gc [flags]",
+		Short: "Delete the pods left behind by crashed or killed runs",
+		Args:  cobra.NoArgs,
+		Run: func(cmd *cobra.Command, args []string) {
+			gcOptions.Namespace = job.Namespace
+
+			exit(0, newRunner().GC(context.Background(), &gcOptions,
+				service.Os.Stdout()))
+		},
+	}
+
+	gc.Flags().StringVar(&gcOptions.Instance, "instance", job.Instance,
+		"AutoSys instance whose pods to delete, all instances when empty")
+	gc.Flags().DurationVar(&gcOptions.MinAge, "min-age", 10*time.Minute,
+		"Minimum age of the pods without a heartbeat to delete")
+	gc.Flags().BoolVar(&gcOptions.DryRun, "dry-run", false,
+		"Print the pods to delete without deleting them")
+	cmd.AddCommand(&cobra.Command{
+		// the subcommands shadow the templates named after them
+		Use:   "run [flags] template [-- args ...]",
+		Short: "Run the template, even one named after a subcommand",
+		Args:  cobra.MinimumNArgs(1),
+		Run:   run,
+	}, &cobra.Command{
+		Use:   "start [flags] template [-- args ...]",
+		Short: "Start the pod and print its handle without waiting for it",
+		Args:  cobra.MinimumNArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			prepare(args)
+
+			job.Detached = true
+			execution, err := newRunner().Start(context.Background(), &job)
 
 			if err != nil {
-				service.Log.Error(err)
-				service.Os.Exit(128)
+				exit(-1, err)
 			}
 
-			service.Os.Exit(exitCode)
+			fmt.Fprintln(service.Os.Stdout(), execution.Handle())
+			exit(0, nil)
 		},
-	}
+	}, &cobra.Command{
+		Use:   "wait [flags] handle",
+		Short: "Wait for a started pod to complete and exit with its exit code",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobRunner := newRunner()
+			ctx, stop := service.Os.NotifyContext(context.Background(),
+				os.Interrupt, syscall.SIGTERM)
+
+			defer stop()
+
+			exit(jobRunner.Wait(ctx, args[0], &job))
+		},
+	}, &cobra.Command{
+		Use:   "logs [flags] handle",
+		Short: "Follow the logs of a started pod",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			jobRunner := newRunner()
+			ctx, stop := service.Os.NotifyContext(context.Background(),
+				os.Interrupt, syscall.SIGTERM)
+
+			defer stop()
+
+			exit(0, jobRunner.Logs(ctx, args[0], &job, service.Os.Stdout()))
+		},
+	}, &cobra.Command{
+		Use:   "status [flags] handle",
+		Short: "Print the status of a started pod",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exit(0, newRunner().Status(context.Background(), args[0], &job,
+				service.Os.Stdout()))
+		},
+	}, gc, &cobra.Command{
+		Use:   "kill [flags] handle",
+		Short: "Kill a started pod",
+		Args:  cobra.ExactArgs(1),
+		Run: func(cmd *cobra.Command, args []string) {
+			exit(0, newRunner().Kill(context.Background(), args[0], &job))
+		},
+	})
 
 	cmd.PersistentFlags().StringVar(&kubeconfig, "kubeconfig", "",
 		"Kubernetes client configuration file")
+	cmd.PersistentFlags().StringVar(&logLevel, "log-level", "info",
+		"Level of the k8srun messages, panic, fatal, error, warn, info, "+
+			"debug or trace")
+	cmd.PersistentFlags().StringVar(&logFormat, "log-format",
+		service.LOG_FORMAT_TEXT, "Format of the k8srun messages, text or json")
+	cmd.PersistentFlags().StringVar(&logFile, "log-file", "",
+		"Append the k8srun messages to the file instead of the standard error")
+	cmd.PersistentFlags().StringVar(&job.Date, "date", "",
+		"Business date of the run, YYYY-MM-DD, for the templates of the "+
+			"pod fields")
 	cmd.PersistentFlags().StringVarP(&job.Namespace, "namespace", "n", "",
 		"The namespace for creating the pod")
+	cmd.PersistentFlags().StringVar(&job.TemplateKind, "template-kind",
+		runner.KIND_POD_TEMPLATE,
+		"Kind of the template in the cluster, PodTemplate or K8sRunTemplate")
+	cmd.PersistentFlags().StringVar(&job.TemplateFile, "template-file", "",
+		"Read the template from a local YAML file or directory instead of "+
+			"the cluster")
+	cmd.PersistentFlags().StringVar(&job.TemplateConfigMap,
+		"template-config-map", "",
+		"Read the template from a key of the config map instead of a "+
+			"PodTemplate")
+	cmd.PersistentFlags().StringVar(&job.Overrides.Image, "image", "",
+		"Image of the main container, if allowed by the template")
+	cmd.PersistentFlags().StringArrayVar(&job.Overrides.Env, "env", nil,
+		"NAME=VALUE variable of the main container, if allowed by the "+
+			"template")
+	cmd.PersistentFlags().StringVar(&job.Overrides.EnvFile, "env-file", "",
+		"File of NAME=VALUE variables of the main container, if allowed by "+
+			"the template")
+	cmd.PersistentFlags().StringVar(&job.Overrides.CPU, "cpu", "",
+		"CPU request of the main container, if allowed by the template")
+	cmd.PersistentFlags().StringVar(&job.Overrides.Memory, "memory", "",
+		"Memory request of the main container, if allowed by the template")
+	cmd.PersistentFlags().StringVar(&job.Overrides.CPULimit, "cpu-limit", "",
+		"CPU limit of the main container, if allowed by the template")
+	cmd.PersistentFlags().StringVar(&job.Overrides.MemoryLimit,
+		"memory-limit", "",
+		"Memory limit of the main container, if allowed by the template")
+	cmd.PersistentFlags().StringToStringVar(&job.Overrides.NodeSelector,
+		"node-selector", nil,
+		"KEY=VALUE node selector of the pod, if allowed by the template")
+	cmd.PersistentFlags().StringArrayVar(&job.Overrides.Tolerations,
+		"toleration", nil,
+		"KEY[=VALUE]:EFFECT toleration of the pod, if allowed by the template")
+	cmd.PersistentFlags().StringVar(&job.Overrides.ServiceAccount,
+		"service-account", "",
+		"Service account of the pod, if allowed by the template")
+	cmd.PersistentFlags().StringArrayVar(&job.PatchFiles, "patch-file", nil,
+		"Patch of the pod, applied in order, if allowed by the template")
+	cmd.PersistentFlags().StringVar(&job.PatchType, "patch-type", "",
+		"Type of the patches, strategic, merge or json, strategic or json "+
+			"depending on the patch when empty")
+	cmd.PersistentFlags().StringSliceVar(&autoEnv, "auto-env", nil,
+		"Additional AUTO* environment variables to pass to the container")
+	cmd.PersistentFlags().StringVar(&job.Backend, "backend", "",
+		"Execution backend, pod or job, overrides the template annotation")
+	cmd.PersistentFlags().StringVar(&job.DryRun, "dry-run", "",
+		"Print the pod instead of running it, client or server to validate "+
+			"it with the API server")
+	cmd.PersistentFlags().Lookup("dry-run").NoOptDefVal = runner.DRY_RUN_CLIENT
+	cmd.PersistentFlags().BoolVar(&job.Fresh, "fresh", false,
+		"Start a new pod even if the same AutoSys run still has a running one")
+	cmd.PersistentFlags().StringVar(&job.Lock, "lock", "",
+		"Lock the job while it runs, fail, wait or skip when another run "+
+			"holds the lock, no lock by default")
+	cmd.PersistentFlags().StringVar(&job.Events, "events", runner.EVENTS_ALL,
+		"Kubernetes events of the pod to log while it starts and when it "+
+			"fails, none, warnings or all")
+	cmd.PersistentFlags().StringVarP(&job.Output, "output", "o",
+		runner.OUTPUT_YAML, "Dry run output format, yaml or json")
+	cmd.PersistentFlags().StringVar(&job.Report, "report", "",
+		"Write a JSON summary of the run to the file")
+	cmd.PersistentFlags().StringVar(&job.MetricsDir, "metrics-dir", "",
+		"Write the metrics of the run to the textfile collector directory "+
+			"of the node exporter")
+	cmd.PersistentFlags().StringVar(&job.MetricsURL, "metrics-url", "",
+		"Push the run as gauges to the Pushgateway URL, e.g. "+
+			"http://pushgateway:9091/metrics/job/k8srun, grouped by the "+
+			"instance, the job and the template")
+	cmd.PersistentFlags().StringVar(&job.KeepPod, "keep-pod", "",
+		"Keep the pod after the run, never, on-failure or always, overrides "+
+			"the template annotation")
+	cmd.PersistentFlags().DurationVar(&job.Retention, "retention",
+		24*time.Hour, "How long a kept pod is retained before it is cleaned up")
+	cmd.PersistentFlags().DurationVar(&job.GracePeriod, "grace-period",
+		30*time.Second,
+		"Grace period for the pod termination when k8srun is killed")
+	cmd.PersistentFlags().DurationVar(&job.QueueTimeout, "queue-timeout", 0,
+		"Maximum wait for a free slot of the concurrency limits, no limit "+
+			"when 0")
+	cmd.PersistentFlags().DurationVar(&job.StartTimeout, "start-timeout", 0,
+		"Maximum time for the pod to get scheduled and start running, "+
+			"the template default or 5m when 0")
+	cmd.PersistentFlags().DurationVar(&job.Timeout, "timeout", 0,
+		"Overall deadline for the job, no deadline when 0")
+	cmd.PersistentFlags().DurationVar(&job.CompletionTimeout,
+		"completion-timeout", 0,
+		"Maximum wait for the container to terminate after its log stream "+
+			"ends, no limit when 0")
 	cmd.SetArgs(service.Os.Args()[1:])
 	cmd.SetErr(service.Os.Stderr())
 	cmd.SetIn(service.Os.Stdin())
@@ -3,7 +3,11 @@ package main
 import (
 	"context"
 	"fmt"
+	"io"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/ayashkov/k8srun/mock"
 	"github.com/ayashkov/k8srun/runner"
@@ -12,6 +16,8 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 )
 
 var logger *test.Hook
@@ -44,6 +50,7 @@ func setUp(t *testing.T, args ...string) *assert.Assertions {
 
 	mockOs.Setenv("AUTOSERV", "ACE")
 	mockOs.Setenv("AUTO_JOB_NAME", "TEST_JOB")
+	mockOs.Setenv("AUTORUN", "")
 	mockOs.SetArgs(args...)
 
 	ctrl := gomock.NewController(t)
@@ -55,6 +62,22 @@ func setUp(t *testing.T, args ...string) *assert.Assertions {
 	return assert.New(t)
 }
 
+func expectedJob() *runner.Job {
+	return &runner.Job{
+		Instance:     "ACE",
+		Name:         "TEST_JOB",
+		Machine:      "localhost",
+		Namespace:    "",
+		Template:     "template",
+		Args:         []string{},
+		Events:       "all",
+		Output:       "yaml",
+		GracePeriod:  30 * time.Second,
+		TemplateKind: "PodTemplate",
+		Retention:    24 * time.Hour,
+	}
+}
+
 func Test_Main_ShowsUsage_WhenNoArgs(t *testing.T) {
 	assert := setUp(t, "k8srun")
 
@@ -93,18 +116,13 @@ func Test_Main_LogsError_WhenNoAutoJobName(t *testing.T) {
 func Test_Main_RunsJob_Normally(t *testing.T) {
 	assert := setUp(t, "k8srun", "template")
 
+	job := expectedJob()
+
 	mockRunnerFactory.EXPECT().
 		New("").
 		Return(mockRunner, nil)
 	mockRunner.EXPECT().
-		Run(context.Background(),
-			&runner.Job{
-				Instance:  "ACE",
-				Name:      "TEST_JOB",
-				Namespace: "",
-				Template:  "template",
-				Args:      []string{},
-			}, service.Os.Stdout()).
+		Run(gomock.Any(), job, service.Os.Stdout()).
 		Return(0, nil)
 
 	mock.ExitsWith(t, 0, main)
@@ -130,18 +148,14 @@ func Test_Main_UsesKubeconfig_WhenKubeconfigFlag(t *testing.T) {
 func Test_Main_SuppliesNamespaceToPod_WhenNamespaceFlag(t *testing.T) {
 	assert := setUp(t, "k8srun", "template", "--namespace=build")
 
+	job := expectedJob()
+	job.Namespace = "build"
+
 	mockRunnerFactory.EXPECT().
 		New("").
 		Return(mockRunner, nil)
 	mockRunner.EXPECT().
-		Run(context.Background(),
-			&runner.Job{
-				Instance:  "ACE",
-				Name:      "TEST_JOB",
-				Namespace: "build",
-				Template:  "template",
-				Args:      []string{},
-			}, service.Os.Stdout()).
+		Run(gomock.Any(), job, service.Os.Stdout()).
 		Return(0, nil)
 
 	mock.ExitsWith(t, 0, main)
@@ -152,18 +166,33 @@ func Test_Main_SuppliesNamespaceToPod_WhenNamespaceFlag(t *testing.T) {
 func Test_Main_SuppliesNamespaceToPod_WhenNFlag(t *testing.T) {
 	assert := setUp(t, "k8srun", "template", "-n", "dev")
 
+	job := expectedJob()
+	job.Namespace = "dev"
+
 	mockRunnerFactory.EXPECT().
 		New("").
 		Return(mockRunner, nil)
 	mockRunner.EXPECT().
-		Run(context.Background(),
-			&runner.Job{
-				Instance:  "ACE",
-				Name:      "TEST_JOB",
-				Namespace: "dev",
-				Template:  "template",
-				Args:      []string{},
-			}, service.Os.Stdout()).
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_RunsTemplateNamedAfterSubcommand_WhenRunCommand(t *testing.T) {
+	assert := setUp(t, "k8srun", "run", "start", "--", "ls")
+
+	job := expectedJob()
+	job.Template = "start"
+	job.Args = []string{"ls"}
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
 		Return(0, nil)
 
 	mock.ExitsWith(t, 0, main)
@@ -174,18 +203,14 @@ func Test_Main_SuppliesNamespaceToPod_WhenNFlag(t *testing.T) {
 func Test_Main_SuppliesArgsToContainer_WhenProvided(t *testing.T) {
 	assert := setUp(t, "k8srun", "template", "--", "ls", "-la", "/")
 
+	job := expectedJob()
+	job.Args = []string{"ls", "-la", "/"}
+
 	mockRunnerFactory.EXPECT().
 		New("").
 		Return(mockRunner, nil)
 	mockRunner.EXPECT().
-		Run(context.Background(),
-			&runner.Job{
-				Instance:  "ACE",
-				Name:      "TEST_JOB",
-				Namespace: "",
-				Template:  "template",
-				Args:      []string{"ls", "-la", "/"},
-			}, service.Os.Stdout()).
+		Run(gomock.Any(), job, service.Os.Stdout()).
 		Return(0, nil)
 
 	mock.ExitsWith(t, 0, main)
@@ -238,3 +263,538 @@ func Test_Main_LogsError_WhenRunReportsError(t *testing.T) {
 	assert.Equal(logrus.ErrorLevel, logger.LastEntry().Level)
 	assert.Equal(logger.LastEntry().Message, "error running")
 }
+
+func Test_Main_UsesGracePeriod_WhenGracePeriodFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--grace-period=2m")
+
+	job := expectedJob()
+	job.GracePeriod = 2 * time.Minute
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_UsesTimeouts_WhenTimeoutFlags(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--start-timeout=10m",
+		"--timeout=2h", "--completion-timeout=30s")
+
+	job := expectedJob()
+	job.StartTimeout = 10 * time.Minute
+	job.Timeout = 2 * time.Hour
+	job.CompletionTimeout = 30 * time.Second
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_UsesBackend_WhenBackendFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--backend=job")
+
+	job := expectedJob()
+	job.Backend = "job"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_PassesAutoSysContext_WhenAvailable(t *testing.T) {
+	assert := setUp(t, "k8srun", "template",
+		"--auto-env=AUTO_JOB_PID,AUTOUSER")
+
+	mockOs.Setenv("AUTORUN", "1234")
+	mockOs.Setenv("AUTO_JOB_PID", "42")
+	mockOs.Setenv("AUTOUSER", "autosys")
+
+	job := expectedJob()
+	job.RunNumber = "1234"
+	job.Env = map[string]string{"AUTO_JOB_PID": "42", "AUTOUSER": "autosys"}
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_LogsError_WhenPassingOtherVariables(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--auto-env=PATH")
+
+	mock.ExitsWith(t, 1, main)
+
+	assert.Equal(1, len(logger.Entries))
+	assert.Equal(logrus.FatalLevel, logger.LastEntry().Level)
+	assert.Equal("only AutoSys variables can be passed, got PATH",
+		logger.LastEntry().Message)
+}
+
+func Test_Main_RequestsClientDryRun_WhenDryRunFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "--dry-run", "template")
+
+	job := expectedJob()
+	job.DryRun = "client"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_RequestsServerDryRun_WhenDryRunServerFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "--dry-run=server", "-o", "json", "template")
+
+	job := expectedJob()
+	job.DryRun = "server"
+	job.Output = "json"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_CancelsRun_WhenSignaled(t *testing.T) {
+	assert := setUp(t, "k8srun", "template")
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), gomock.Any(), gomock.Any()).
+		DoAndReturn(func(ctx context.Context, job *runner.Job,
+			out io.Writer) (int, error) {
+			mockOs.Signal()
+
+			<-ctx.Done()
+
+			return -1, &runner.ExitError{
+				Code: runner.EXIT_KILLED,
+				Err:  fmt.Errorf("killed"),
+			}
+		})
+
+	mock.ExitsWith(t, runner.EXIT_KILLED, main)
+
+	assert.Equal(1, len(logger.Entries))
+	assert.Equal(logrus.ErrorLevel, logger.LastEntry().Level)
+	assert.Equal("killed", logger.LastEntry().Message)
+}
+
+func Test_Main_UsesRetention_WhenKeepPodFlags(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--keep-pod=on-failure",
+		"--retention=2h")
+
+	job := expectedJob()
+	job.KeepPod = "on-failure"
+	job.Retention = 2 * time.Hour
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_PrintsHandle_WhenStartCommand(t *testing.T) {
+	assert := setUp(t, "k8srun", "start", "template")
+
+	job := expectedJob()
+	job.Detached = true
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Start(gomock.Any(), job).
+		Return(&runner.Execution{Pod: &core.Pod{
+			ObjectMeta: meta.ObjectMeta{Name: "pod", Namespace: "namespace"},
+		}}, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Equal("pod/namespace/pod\n", mockOs.StdoutBuffer().String())
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_ExitsWithExitCode_WhenWaitCommand(t *testing.T) {
+	assert := setUp(t, "k8srun", "wait", "pod/namespace/pod")
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Wait(gomock.Any(), "pod/namespace/pod", gomock.Any()).
+		Return(3, nil)
+
+	mock.ExitsWith(t, 3, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_LogsError_WhenKillCommandFails(t *testing.T) {
+	assert := setUp(t, "k8srun", "kill", "pod/namespace/pod")
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Kill(gomock.Any(), "pod/namespace/pod", gomock.Any()).
+		Return(fmt.Errorf("kill failed"))
+
+	mock.ExitsWith(t, runner.EXIT_ERROR, main)
+
+	assert.Equal("kill failed", logger.LastEntry().Message)
+}
+
+func Test_Main_RequestsFreshRun_WhenFreshFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--fresh")
+
+	job := expectedJob()
+	job.Fresh = true
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_LocksJob_WhenLockFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--lock=wait")
+
+	job := expectedJob()
+	job.Lock = "wait"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_UsesQueueTimeout_WhenQueueTimeoutFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--queue-timeout=10m")
+
+	job := expectedJob()
+	job.QueueTimeout = 10 * time.Minute
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_UsesTemplateSource_WhenTemplateFlags(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--template-file=templates",
+		"--template-config-map=templates")
+
+	job := expectedJob()
+	job.TemplateFile = "templates"
+	job.TemplateConfigMap = "templates"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_UsesTemplateKind_WhenTemplateKindFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--template-kind=K8sRunTemplate")
+
+	job := expectedJob()
+	job.TemplateKind = "K8sRunTemplate"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_PassesOverrides_WhenOverrideFlags(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--image=alpine:3",
+		"--env=A=1", "--env=B=2,3", "--env-file=job.env", "--cpu=100m",
+		"--memory=1Gi", "--cpu-limit=1", "--memory-limit=2Gi",
+		"--node-selector=zone=a", "--toleration=batch:NoSchedule",
+		"--service-account=batch")
+
+	job := expectedJob()
+	job.Overrides = runner.Overrides{
+		Image:          "alpine:3",
+		Env:            []string{"A=1", "B=2,3"},
+		EnvFile:        "job.env",
+		CPU:            "100m",
+		Memory:         "1Gi",
+		CPULimit:       "1",
+		MemoryLimit:    "2Gi",
+		NodeSelector:   map[string]string{"zone": "a"},
+		Tolerations:    []string{"batch:NoSchedule"},
+		ServiceAccount: "batch",
+	}
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_PassesPatches_WhenPatchFlags(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--patch-file=qa.yaml",
+		"--patch-file=site.json", "--patch-type=json")
+
+	job := expectedJob()
+	job.PatchFiles = []string{"qa.yaml", "site.json"}
+	job.PatchType = "json"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_PassesBusinessDate_WhenDateFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--date=2026-10-18")
+
+	job := expectedJob()
+	job.Date = "2026-10-18"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_DeletesOrphans_WhenGCCommand(t *testing.T) {
+	assert := setUp(t, "k8srun", "gc", "-n", "namespace", "--dry-run",
+		"--min-age", "1h")
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		GC(gomock.Any(), &runner.GCOptions{
+			Namespace: "namespace",
+			Instance:  "ACE",
+			MinAge:    time.Hour,
+			DryRun:    true,
+		}, service.Os.Stdout()).
+		Return(nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_DeletesOrphans_WhenGCDryRunIsFalse(t *testing.T) {
+	assert := setUp(t, "k8srun", "gc", "--dry-run=false")
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		GC(gomock.Any(), &runner.GCOptions{
+			Instance: "ACE",
+			MinAge:   10 * time.Minute,
+		}, service.Os.Stdout()).
+		Return(nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_DeletesOrphansOfAllInstances_WhenGCInstanceIsEmpty(t *testing.T) {
+	assert := setUp(t, "k8srun", "gc", "--instance=")
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		GC(gomock.Any(), &runner.GCOptions{MinAge: 10 * time.Minute},
+			service.Os.Stdout()).
+		Return(nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_WritesReport_WhenReportFlag(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--report", "report.json")
+
+	job := expectedJob()
+	job.Report = "report.json"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_RecordsMetrics_WhenMetricsFlags(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--metrics-dir", "/textfile",
+		"--metrics-url", "http://pushgateway:9091/metrics/job/k8srun")
+
+	job := expectedJob()
+	job.MetricsDir = "/textfile"
+	job.MetricsURL = "http://pushgateway:9091/metrics/job/k8srun"
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), job, service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Empty(logger.Entries)
+}
+
+func Test_Main_ConfiguresLog_WhenLogFlags(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--log-level", "debug",
+		"--log-format", "json")
+
+	t.Cleanup(func() {
+		service.Log.SetLevel(logrus.InfoLevel)
+		service.Log.SetFormatter(&logrus.TextFormatter{})
+	})
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), expectedJob(), service.Os.Stdout()).
+		Return(0, nil)
+
+	mock.ExitsWith(t, 0, main)
+
+	assert.Equal(logrus.DebugLevel, service.Log.Level)
+	assert.IsType(&logrus.JSONFormatter{}, service.Log.Formatter)
+}
+
+func Test_Main_ClosesLogFile_WhenExiting(t *testing.T) {
+	file := filepath.Join(t.TempDir(), "k8srun.log")
+	assert := setUp(t, "k8srun", "template", "--log-file", file)
+	out := service.Log.Out
+
+	mockRunnerFactory.EXPECT().
+		New("").
+		Return(mockRunner, nil)
+	mockRunner.EXPECT().
+		Run(gomock.Any(), expectedJob(), service.Os.Stdout()).
+		Return(-1, fmt.Errorf("failed"))
+
+	mock.ExitsWith(t, runner.EXIT_ERROR, main)
+
+	content, err := os.ReadFile(file)
+
+	assert.Nil(err)
+	assert.Contains(string(content), "msg=failed")
+	assert.Equal(out, service.Log.Out)
+}
+
+func Test_Main_LogsError_WhenLogFormatIsUnknown(t *testing.T) {
+	assert := setUp(t, "k8srun", "template", "--log-format", "xml")
+
+	mock.ExitsWith(t, runner.EXIT_ERROR, main)
+
+	assert.Equal("unsupported log format \"xml\", expected \"text\" or "+
+		"\"json\"", logger.LastEntry().Message)
+}
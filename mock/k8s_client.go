@@ -8,6 +8,7 @@ import (
 	reflect "reflect"
 
 	gomock "github.com/golang/mock/gomock"
+	dynamic "k8s.io/client-go/dynamic"
 	kubernetes "k8s.io/client-go/kubernetes"
 	rest "k8s.io/client-go/rest"
 	clientcmd "k8s.io/client-go/tools/clientcmd"
@@ -64,3 +65,18 @@ func (mr *MockK8sClientMockRecorder) NewClientset(c interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewClientset", reflect.TypeOf((*MockK8sClient)(nil).NewClientset), c)
 }
+
+// NewDynamicClient mocks base method.
+func (m *MockK8sClient) NewDynamicClient(c *rest.Config) (dynamic.Interface, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "NewDynamicClient", c)
+	ret0, _ := ret[0].(dynamic.Interface)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// NewDynamicClient indicates an expected call of NewDynamicClient.
+func (mr *MockK8sClientMockRecorder) NewDynamicClient(c interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "NewDynamicClient", reflect.TypeOf((*MockK8sClient)(nil).NewDynamicClient), c)
+}
@@ -2,27 +2,34 @@ package mock
 
 import (
 	"bytes"
+	"context"
 	"io"
+	"os"
+	"sync"
 	"testing"
 
 	"github.com/stretchr/testify/assert"
 )
 
 type MockOsServices struct {
-	args   []string
-	env    map[string]string
-	stderr *bytes.Buffer
-	stdin  *bytes.Buffer
-	stdout *bytes.Buffer
+	args     []string
+	env      map[string]string
+	hostname string
+	mutex    sync.Mutex
+	cancels  []context.CancelFunc
+	stderr   *bytes.Buffer
+	stdin    *bytes.Buffer
+	stdout   *bytes.Buffer
 }
 
 func NewMockOsServices() *MockOsServices {
 	return &MockOsServices{
-		args:   []string{"a.out"},
-		env:    map[string]string{},
-		stderr: new(bytes.Buffer),
-		stdin:  new(bytes.Buffer),
-		stdout: new(bytes.Buffer),
+		args:     []string{"a.out"},
+		env:      map[string]string{},
+		hostname: "localhost",
+		stderr:   new(bytes.Buffer),
+		stdin:    new(bytes.Buffer),
+		stdout:   new(bytes.Buffer),
 	}
 }
 
@@ -62,6 +69,37 @@ func (mock *MockOsServices) Setenv(key string, value string) {
 	mock.env[key] = value
 }
 
+func (mock *MockOsServices) Hostname() (string, error) {
+	return mock.hostname, nil
+}
+
+func (mock *MockOsServices) SetHostname(hostname string) {
+	mock.hostname = hostname
+}
+
+func (mock *MockOsServices) NotifyContext(parent context.Context,
+	signals ...os.Signal) (context.Context, context.CancelFunc) {
+	ctx, cancel := context.WithCancel(parent)
+
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+
+	mock.cancels = append(mock.cancels, cancel)
+
+	return ctx, cancel
+}
+
+func (mock *MockOsServices) Signal() {
+	mock.mutex.Lock()
+	defer mock.mutex.Unlock()
+
+	for _, cancel := range mock.cancels {
+		cancel()
+	}
+
+	mock.cancels = nil
+}
+
 func (mock *MockOsServices) Stderr() io.Writer {
 	return mock.stderr
 }
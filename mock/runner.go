@@ -36,6 +36,48 @@ func (m *MockRunner) EXPECT() *MockRunnerMockRecorder {
 	return m.recorder
 }
 
+// GC mocks base method.
+func (m *MockRunner) GC(ctx context.Context, options *runner.GCOptions, out io.Writer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "GC", ctx, options, out)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// GC indicates an expected call of GC.
+func (mr *MockRunnerMockRecorder) GC(ctx, options, out interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "GC", reflect.TypeOf((*MockRunner)(nil).GC), ctx, options, out)
+}
+
+// Kill mocks base method.
+func (m *MockRunner) Kill(ctx context.Context, handle string, job *runner.Job) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Kill", ctx, handle, job)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Kill indicates an expected call of Kill.
+func (mr *MockRunnerMockRecorder) Kill(ctx, handle, job interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Kill", reflect.TypeOf((*MockRunner)(nil).Kill), ctx, handle, job)
+}
+
+// Logs mocks base method.
+func (m *MockRunner) Logs(ctx context.Context, handle string, job *runner.Job, out io.Writer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Logs", ctx, handle, job, out)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Logs indicates an expected call of Logs.
+func (mr *MockRunnerMockRecorder) Logs(ctx, handle, job, out interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Logs", reflect.TypeOf((*MockRunner)(nil).Logs), ctx, handle, job, out)
+}
+
 // Run mocks base method.
 func (m *MockRunner) Run(ctx context.Context, job *runner.Job, out io.Writer) (int, error) {
 	m.ctrl.T.Helper()
@@ -65,3 +107,32 @@ func (mr *MockRunnerMockRecorder) Start(ctx, job interface{}) *gomock.Call {
 	mr.mock.ctrl.T.Helper()
 	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Start", reflect.TypeOf((*MockRunner)(nil).Start), ctx, job)
 }
+
+// Status mocks base method.
+func (m *MockRunner) Status(ctx context.Context, handle string, job *runner.Job, out io.Writer) error {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Status", ctx, handle, job, out)
+	ret0, _ := ret[0].(error)
+	return ret0
+}
+
+// Status indicates an expected call of Status.
+func (mr *MockRunnerMockRecorder) Status(ctx, handle, job, out interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Status", reflect.TypeOf((*MockRunner)(nil).Status), ctx, handle, job, out)
+}
+
+// Wait mocks base method.
+func (m *MockRunner) Wait(ctx context.Context, handle string, job *runner.Job) (int, error) {
+	m.ctrl.T.Helper()
+	ret := m.ctrl.Call(m, "Wait", ctx, handle, job)
+	ret0, _ := ret[0].(int)
+	ret1, _ := ret[1].(error)
+	return ret0, ret1
+}
+
+// Wait indicates an expected call of Wait.
+func (mr *MockRunnerMockRecorder) Wait(ctx, handle, job interface{}) *gomock.Call {
+	mr.mock.ctrl.T.Helper()
+	return mr.mock.ctrl.RecordCallWithMethodType(mr.mock, "Wait", reflect.TypeOf((*MockRunner)(nil).Wait), ctx, handle, job)
+}
@@ -0,0 +1,96 @@
+package runner
+
+import (
+	"fmt"
+	"path"
+	"regexp"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+)
+
+const INSTANCE_DENY = "k8srun.yashkov.org/instance-deny"
+
+const PREFIX_DENY = "k8srun.yashkov.org/prefix-deny"
+
+// checkAnnotation checks a run against the comma-separated rules of the
+// allow and the deny annotations. A plain rule equals value, ignoring the
+// case, while a glob or a /regex/ rule matches the whole of name.
+func checkAnnotation(template *core.PodTemplate, allow string, deny string,
+	value string, name string) error {
+	for _, rule := range rules(template.Annotations[deny]) {
+		matched, err := matchRule(rule, value, name)
+
+		if err != nil {
+			return fmt.Errorf("template annotation %v: %w", deny, err)
+		}
+
+		if matched {
+			return fmt.Errorf("template annotation %v rule %q rejects %q",
+				deny, rule, name)
+		}
+	}
+
+	allowed := rules(template.Annotations[allow])
+
+	for _, rule := range allowed {
+		matched, err := matchRule(rule, value, name)
+
+		if err != nil {
+			return fmt.Errorf("template annotation %v: %w", allow, err)
+		}
+
+		if matched {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("template annotation %v does not match %q, "+
+		"allowed %q", allow, value, allowed)
+}
+
+// ruleToken matches the first rule of a list, a /regex/ rule running to the
+// first slash followed by a comma so that its commas are kept
+var ruleToken = regexp.MustCompile(`^\s*(/.*?/|[^,]*)\s*(?:,|$)`)
+
+func rules(annotation string) []string {
+	rules := []string{}
+
+	for rest := annotation; rest != ""; {
+		token := ruleToken.FindStringSubmatch(rest)
+
+		rest = rest[len(token[0]):]
+
+		if rule := strings.TrimSpace(token[1]); rule != "" {
+			rules = append(rules, rule)
+		}
+	}
+
+	return rules
+}
+
+func matchRule(rule string, value string, name string) (bool, error) {
+	if len(rule) > 1 && strings.HasPrefix(rule, "/") &&
+		strings.HasSuffix(rule, "/") {
+		re, err := regexp.Compile("(?i)^(?:" + rule[1:len(rule)-1] + ")$")
+
+		if err != nil {
+			return false, fmt.Errorf("invalid rule %q: %w", rule, err)
+		}
+
+		return re.MatchString(name), nil
+	}
+
+	if strings.ContainsAny(rule, "*?[") {
+		matched, err := path.Match(strings.ToLower(rule),
+			strings.ToLower(name))
+
+		if err != nil {
+			return false, fmt.Errorf("invalid rule %q: %w", rule, err)
+		}
+
+		return matched, nil
+	}
+
+	return strings.ToLower(rule) == value, nil
+}
@@ -0,0 +1,358 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+
+	"github.com/ayashkov/k8srun/service"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const BACKEND = "k8srun.yashkov.org/backend"
+
+const BACKOFF_LIMIT = "k8srun.yashkov.org/backoff-limit"
+
+const TTL_AFTER_FINISHED = "k8srun.yashkov.org/ttl-seconds-after-finished"
+
+const (
+	BACKEND_POD = "pod"
+	BACKEND_JOB = "job"
+)
+
+const defaultTTLAfterFinished = 3600
+
+func backend(template *core.PodTemplate, job *Job) (string, error) {
+	backend := job.Backend
+
+	if backend == "" {
+		backend = template.Annotations[BACKEND]
+	}
+
+	switch backend {
+	case "", BACKEND_POD:
+		return BACKEND_POD, nil
+	case BACKEND_JOB:
+		return BACKEND_JOB, nil
+	}
+
+	return "", fmt.Errorf("unsupported backend %q, expected %q or %q",
+		backend, BACKEND_POD, BACKEND_JOB)
+}
+
+func newBatchJob(template *core.PodTemplate, pod *core.Pod,
+	job *Job) (*batch.Job, error) {
+	backoffLimit, err := int32Annotation(template, BACKOFF_LIMIT, 0)
+
+	if err != nil {
+		return nil, err
+	}
+
+	ttl, err := int32Annotation(template, TTL_AFTER_FINISHED,
+		defaultTTLAfterFinished)
+
+	if err != nil {
+		return nil, err
+	}
+
+	podTemplate := core.PodTemplateSpec{
+		ObjectMeta: *pod.ObjectMeta.DeepCopy(),
+		Spec:       *pod.Spec.DeepCopy(),
+	}
+
+	podTemplate.GenerateName = ""
+	podTemplate.Spec.ActiveDeadlineSeconds = nil
+
+	if podTemplate.Spec.RestartPolicy == "" ||
+		podTemplate.Spec.RestartPolicy == core.RestartPolicyAlways {
+		podTemplate.Spec.RestartPolicy = core.RestartPolicyNever
+	}
+
+	batchJob := &batch.Job{
+		ObjectMeta: meta.ObjectMeta{
+			GenerateName: pod.GenerateName,
+			Labels:       pod.Labels,
+			Annotations:  pod.Annotations,
+		},
+		Spec: batch.JobSpec{
+			BackoffLimit:            &backoffLimit,
+			TTLSecondsAfterFinished: &ttl,
+			ActiveDeadlineSeconds:   pod.Spec.ActiveDeadlineSeconds,
+			Template:                podTemplate,
+		},
+	}
+
+	return batchJob, nil
+}
+
+func int32Annotation(template *core.PodTemplate, name string,
+	value int32) (int32, error) {
+	text, ok := template.Annotations[name]
+
+	if !ok {
+		return value, nil
+	}
+
+	parsed, err := strconv.ParseInt(text, 10, 32)
+
+	if err != nil || parsed < 0 {
+		return 0, fmt.Errorf("template annotation %v must be a non-negative "+
+			"integer, got %q", name, text)
+	}
+
+	return int32(parsed), nil
+}
+
+// copyAttemptLogs follows the pods the Job controller creates one after
+// another until the Job finishes
+func (execution *Execution) copyAttemptLogs(ctx context.Context,
+	dst io.Writer) error {
+	followed := ""
+
+	for {
+		pod, err := execution.nextAttempt(ctx, followed)
+
+		if err != nil || pod == nil {
+			return err
+		}
+
+		followed = pod.Name
+		execution.setCurrent(pod)
+		logPod(pod.Namespace, pod.Name)
+		service.Log.Infof("following pod %q of job %q", pod.Name,
+			execution.BatchJob.Name)
+
+		if err := execution.copyPodLogs(ctx, dst); err != nil {
+			return err
+		}
+
+		exitCode, err := execution.completePod(ctx)
+
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+
+			service.Log.Warn(err)
+		} else if exitCode == 0 {
+			// the Job may not have completed, its sidecars were stopped by
+			// suspending it
+			execution.succeeded = true
+
+			return nil
+		}
+	}
+}
+
+func (execution *Execution) nextAttempt(ctx context.Context,
+	followed string) (*core.Pod, error) {
+	var next *core.Pod
+
+	execution.track()
+
+	if timeout := execution.job().StartTimeout; followed == "" &&
+		timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+
+		defer cancel()
+	}
+
+	err := execution.group.wait(ctx, func() (bool, error) {
+		if pod := newestPod(execution.tracker.objects); pod != nil &&
+			pod.Name != followed {
+			next = pod
+
+			return true, nil
+		}
+
+		return jobFinished(execution.jobTracker.objects) != nil, nil
+	}, execution.tracker, execution.jobTracker)
+
+	if err == context.DeadlineExceeded {
+		return nil, &ExitError{
+			Code: EXIT_START_TIMEOUT,
+			Err: fmt.Errorf("job %q did not start a pod within %v",
+				execution.BatchJob.Name, execution.job().StartTimeout),
+		}
+	}
+
+	return next, err
+}
+
+// waitForJob waits for the Job to finish and reports the exit code of its
+// final attempt
+func (execution *Execution) waitForJob(ctx context.Context) (int, error) {
+	var condition *batch.JobCondition
+
+	if execution.succeeded {
+		return 0, nil
+	}
+
+	execution.track()
+
+	timeout := execution.job().CompletionTimeout
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+
+		defer cancel()
+	}
+
+	err := execution.group.wait(ctx, func() (bool, error) {
+		condition = jobFinished(execution.jobTracker.objects)
+
+		return condition != nil, nil
+	}, execution.jobTracker)
+
+	if err == context.DeadlineExceeded {
+		return EXIT_COMPLETION_TIMEOUT, &ExitError{
+			Code: EXIT_COMPLETION_TIMEOUT,
+			Err: fmt.Errorf("job %q did not complete within %v",
+				execution.BatchJob.Name, timeout),
+		}
+	}
+
+	if err != nil {
+		return EXIT_ERROR, err
+	}
+
+	if condition.Type == batch.JobFailed &&
+		condition.Reason == "DeadlineExceeded" {
+		return EXIT_RUN_TIMEOUT, &ExitError{
+			Code: EXIT_RUN_TIMEOUT,
+			Err: fmt.Errorf("job %q exceeded its deadline: %v",
+				execution.BatchJob.Name, condition.Message),
+		}
+	}
+
+	execution.group.mutex.Lock()
+	pod := newestPod(execution.tracker.objects)
+	execution.group.mutex.Unlock()
+
+	if pod == nil {
+		return EXIT_ERROR, fmt.Errorf("job %q finished without pods: %v",
+			execution.BatchJob.Name, condition.Message)
+	}
+
+	execution.setCurrent(pod)
+
+	main := mainContainer(pod)
+	terminated := containerTerminated(pod, main)
+
+	if terminated == nil {
+		if failure := podFailure(pod); failure != nil {
+			return failure.Code, execution.failed(ctx, failure)
+		}
+
+		return EXIT_ERROR, execution.failed(ctx, fmt.Errorf(
+			"job %q finished without running container %q: %v",
+			execution.BatchJob.Name, main, condition.Message))
+	}
+
+	if failure := oomKilled(pod, main); failure != nil {
+		return failure.Code, execution.failed(ctx, failure)
+	}
+
+	return int(terminated.ExitCode), nil
+}
+
+// suspendBatchJob makes the Job controller terminate the running pod of the
+// Job without starting another attempt
+func (execution *Execution) suspendBatchJob(ctx context.Context) error {
+	patch, _ := json.Marshal(map[string]any{
+		"spec": map[string]any{"suspend": true},
+	})
+
+	_, err := execution.Jobs.Patch(ctx, execution.BatchJob.Name,
+		types.StrategicMergePatchType, patch, meta.PatchOptions{})
+
+	if err != nil {
+		return fmt.Errorf("error suspending job %q in %q namespace: %w",
+			execution.BatchJob.Name, execution.BatchJob.Namespace, err)
+	}
+
+	return nil
+}
+
+func (execution *Execution) deleteBatchJob(ctx context.Context) error {
+	if execution.jobDeleted.Swap(true) {
+		return nil
+	}
+
+	propagation := meta.DeletePropagationBackground
+	err := execution.Jobs.Delete(ctx, execution.BatchJob.Name,
+		meta.DeleteOptions{PropagationPolicy: &propagation})
+
+	if err != nil && !errors.IsNotFound(err) {
+		execution.jobDeleted.Store(false)
+
+		return fmt.Errorf("error deleting job %q in %q namespace: %w",
+			execution.BatchJob.Name, execution.BatchJob.Namespace, err)
+	}
+
+	execution.markDeleted()
+	service.Log.Infof("deleted job %q in %q namespace",
+		execution.BatchJob.Name, execution.BatchJob.Namespace)
+
+	return nil
+}
+
+func newestPod(objects map[string]runtime.Object) *core.Pod {
+	pods := []*core.Pod{}
+
+	for _, object := range objects {
+		pods = append(pods, object.(*core.Pod))
+	}
+
+	if len(pods) == 0 {
+		return nil
+	}
+
+	sort.Slice(pods, func(i, j int) bool {
+		ti, tj := pods[i].CreationTimestamp, pods[j].CreationTimestamp
+
+		if !ti.Equal(&tj) {
+			return ti.Before(&tj)
+		}
+
+		return pods[i].Name < pods[j].Name
+	})
+
+	return pods[len(pods)-1]
+}
+
+func jobFinished(objects map[string]runtime.Object) *batch.JobCondition {
+	for _, object := range objects {
+		if condition := jobCondition(object.(*batch.Job)); condition != nil {
+			return condition
+		}
+	}
+
+	return nil
+}
+
+// jobCondition returns the condition of the Job telling it has finished,
+// or nil while it is still active
+func jobCondition(batchJob *batch.Job) *batch.JobCondition {
+	for _, condition := range batchJob.Status.Conditions {
+		if (condition.Type == batch.JobComplete ||
+			condition.Type == batch.JobFailed) &&
+			condition.Status == core.ConditionTrue {
+			return &condition
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,102 @@
+package runner
+
+import (
+	"fmt"
+
+	core "k8s.io/api/core/v1"
+)
+
+func mainContainer(pod *core.Pod) string {
+	if name := pod.Annotations[CONTAINER]; name != "" {
+		return name
+	}
+
+	if len(pod.Spec.Containers) == 0 {
+		return ""
+	}
+
+	return pod.Spec.Containers[0].Name
+}
+
+func mainContainerIndex(spec *core.PodSpec, name string) (int, error) {
+	if len(spec.Containers) == 0 {
+		return -1, fmt.Errorf("no containers defined")
+	}
+
+	if name == "" {
+		return 0, nil
+	}
+
+	for i := range spec.Containers {
+		if spec.Containers[i].Name == name {
+			return i, nil
+		}
+	}
+
+	return -1, fmt.Errorf("no container named %q", name)
+}
+
+func containerNames(pod *core.Pod) []string {
+	names := []string{}
+
+	for _, container := range pod.Spec.InitContainers {
+		names = append(names, container.Name)
+	}
+
+	for _, container := range pod.Spec.Containers {
+		names = append(names, container.Name)
+	}
+
+	return names
+}
+
+func sidecars(pod *core.Pod) []string {
+	main := mainContainer(pod)
+	names := []string{}
+
+	for _, container := range pod.Spec.Containers {
+		if container.Name != main {
+			names = append(names, container.Name)
+		}
+	}
+
+	return names
+}
+
+func containerStatus(pod *core.Pod, name string) *core.ContainerStatus {
+	for _, statuses := range [][]core.ContainerStatus{
+		pod.Status.InitContainerStatuses,
+		pod.Status.ContainerStatuses,
+	} {
+		for i := range statuses {
+			if statuses[i].Name == name {
+				return &statuses[i]
+			}
+		}
+	}
+
+	return nil
+}
+
+func containerStarted(pod *core.Pod, name string) bool {
+	status := containerStatus(pod, name)
+
+	return status != nil &&
+		(status.State.Running != nil || status.State.Terminated != nil)
+}
+
+func containerTerminated(pod *core.Pod,
+	name string) *core.ContainerStateTerminated {
+	status := containerStatus(pod, name)
+
+	if status == nil {
+		return nil
+	}
+
+	return status.State.Terminated
+}
+
+func podFinished(pod *core.Pod) bool {
+	return pod.Status.Phase == core.PodSucceeded ||
+		pod.Status.Phase == core.PodFailed
+}
@@ -0,0 +1,107 @@
+package runner
+
+import (
+	"regexp"
+	"sort"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+)
+
+const JOB = "k8srun.yashkov.org/job"
+
+const JOB_NAME = "k8srun.yashkov.org/job-name"
+
+const RUN = "k8srun.yashkov.org/run"
+
+const MACHINE = "k8srun.yashkov.org/machine"
+
+const MANAGED_BY = "app.kubernetes.io/managed-by"
+
+const MANAGER = "k8srun"
+
+var invalidLabelChars = regexp.MustCompile("[^a-z0-9._-]+")
+
+// injectContext passes the AutoSys context of the job to its main
+// container as environment variables and to the pod as labels and
+// annotations, so pods can be correlated with the AutoSys runs
+func injectContext(pod *core.Pod, main int, job *Job) {
+	env := map[string]string{}
+
+	for name, value := range job.Env {
+		env[name] = value
+	}
+
+	env["AUTOSERV"] = job.Instance
+	env["AUTO_JOB_NAME"] = job.Name
+
+	if job.RunNumber != "" {
+		env["AUTORUN"] = job.RunNumber
+	}
+
+	if job.Machine != "" {
+		env["AUTO_MACHINE"] = job.Machine
+	}
+
+	setEnv(&pod.Spec.Containers[main], env)
+
+	if pod.Labels == nil {
+		pod.Labels = map[string]string{}
+	}
+
+	pod.Labels[MANAGED_BY] = MANAGER
+	pod.Labels[INSTANCE] = labelValue(job.Instance)
+	pod.Labels[JOB] = labelValue(job.Name)
+
+	if job.RunNumber != "" {
+		pod.Labels[RUN] = labelValue(job.RunNumber)
+		pod.Labels[RUN_KEY] = runKey(job)
+	}
+
+	pod.Annotations[INSTANCE] = job.Instance
+	pod.Annotations[JOB_NAME] = job.Name
+
+	if job.RunNumber != "" {
+		pod.Annotations[RUN] = job.RunNumber
+	}
+
+	if job.Machine != "" {
+		pod.Annotations[MACHINE] = job.Machine
+	}
+}
+
+func setEnv(container *core.Container, env map[string]string) {
+	for i := range container.Env {
+		if value, ok := env[container.Env[i].Name]; ok {
+			container.Env[i] = core.EnvVar{Name: container.Env[i].Name,
+				Value: value}
+			delete(env, container.Env[i].Name)
+		}
+	}
+
+	names := make([]string, 0, len(env))
+
+	for name := range env {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	for _, name := range names {
+		container.Env = append(container.Env,
+			core.EnvVar{Name: name, Value: env[name]})
+	}
+}
+
+// labelValue turns s into a valid label value: at most 63 characters of
+// alphanumerics, '-', '_' or '.', starting and ending with an alphanumeric
+func labelValue(s string) string {
+	value := invalidLabelChars.ReplaceAllString(
+		strings.ToLower(strings.TrimSpace(s)), "-")
+
+	if len(value) > 63 {
+		value = value[:63]
+	}
+
+	return strings.Trim(value, "._-")
+}
@@ -0,0 +1,194 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/ayashkov/k8srun/service"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// Handle identifies the pod or the Job of the execution as kind/namespace/name,
+// so a detached execution can be attached to later
+func (execution *Execution) Handle() string {
+	if execution.BatchJob != nil {
+		return fmt.Sprintf("%v/%v/%v", BACKEND_JOB,
+			execution.BatchJob.Namespace, execution.BatchJob.Name)
+	}
+
+	pod := execution.current()
+
+	return fmt.Sprintf("%v/%v/%v", BACKEND_POD, pod.Namespace, pod.Name)
+}
+
+// attach looks up the pod or the Job identified by handle and returns its
+// execution, with the timeouts and the keep pod policy of job
+func (runner *defaultRunner) attach(ctx context.Context, handle string,
+	job *Job) (*Execution, error) {
+	parts := strings.Split(handle, "/")
+
+	if len(parts) == 2 {
+		parts = []string{parts[0], runner.jobNamespace(job), parts[1]}
+	}
+
+	if len(parts) != 3 || parts[1] == "" || parts[2] == "" {
+		return nil, fmt.Errorf("invalid handle %q, expected "+
+			"kind/namespace/name", handle)
+	}
+
+	kind, namespace, name := parts[0], parts[1], parts[2]
+
+	logJob(job)
+	logPod(namespace, "")
+
+	execution := &Execution{
+		Job:    job,
+		Pods:   runner.clentset.CoreV1().Pods(namespace),
+		Events: runner.clentset.CoreV1().Events(namespace),
+	}
+
+	var annotations map[string]string
+
+	switch kind {
+	case BACKEND_POD:
+		pod, err := execution.Pods.Get(ctx, name, meta.GetOptions{})
+
+		if err != nil {
+			return nil, err
+		}
+
+		execution.Pod = pod
+		annotations = pod.Annotations
+		logPod(namespace, pod.Name)
+	case BACKEND_JOB:
+		execution.Jobs = runner.clentset.BatchV1().Jobs(namespace)
+
+		batchJob, err := execution.Jobs.Get(ctx, name, meta.GetOptions{})
+
+		if err != nil {
+			return nil, err
+		}
+
+		execution.BatchJob = batchJob
+		annotations = batchJob.Annotations
+	default:
+		return nil, fmt.Errorf("invalid handle %q, unsupported kind %q",
+			handle, kind)
+	}
+
+	keep, err := keepPolicy(&core.PodTemplate{
+		ObjectMeta: meta.ObjectMeta{Annotations: annotations},
+	}, job)
+
+	if err != nil {
+		return nil, err
+	}
+
+	execution.keep = keep
+
+	return execution, nil
+}
+
+func (runner *defaultRunner) Wait(ctx context.Context, handle string,
+	job *Job) (int, error) {
+	execution, err := runner.attach(ctx, handle, job)
+
+	if err != nil {
+		return -1, err
+	}
+
+	exitCode, err := execution.WaitForCompletion(ctx)
+
+	if ctx.Err() != nil {
+		execution.release()
+
+		return -1, &ExitError{
+			Code: EXIT_KILLED,
+			Err: fmt.Errorf("stopped waiting for %v, it keeps running",
+				handle),
+		}
+	}
+
+	failed := exitCode != 0 || err != nil
+
+	if err := execution.Finish(context.Background(), failed); err != nil {
+		service.Log.Error(err)
+	}
+
+	return exitCode, err
+}
+
+func (runner *defaultRunner) Logs(ctx context.Context, handle string,
+	job *Job, out io.Writer) error {
+	execution, err := runner.attach(ctx, handle, job)
+
+	if err != nil {
+		return err
+	}
+
+	defer execution.release()
+
+	err = execution.CopyLogs(ctx, out)
+	execution.drainStreams()
+
+	return err
+}
+
+func (runner *defaultRunner) Status(ctx context.Context, handle string,
+	job *Job, out io.Writer) error {
+	execution, err := runner.attach(ctx, handle, job)
+
+	if err != nil {
+		return err
+	}
+
+	if execution.BatchJob != nil {
+		_, err = fmt.Fprintf(out, "%v %v\n", execution.Handle(),
+			jobStatus(execution.BatchJob))
+
+		return err
+	}
+
+	_, err = fmt.Fprintf(out, "%v %v\n", execution.Handle(),
+		podStatus(execution.Pod))
+
+	return err
+}
+
+func (runner *defaultRunner) Kill(ctx context.Context, handle string,
+	job *Job) error {
+	execution, err := runner.attach(ctx, handle, job)
+
+	if err != nil {
+		return err
+	}
+
+	return execution.Kill(ctx, job.GracePeriod)
+}
+
+func podStatus(pod *core.Pod) string {
+	status := string(pod.Status.Phase)
+
+	if status == "" {
+		status = string(core.PodPending)
+	}
+
+	if terminated := containerTerminated(pod, mainContainer(pod)); terminated != nil {
+		status += fmt.Sprintf(", exit code %v", terminated.ExitCode)
+	}
+
+	return status
+}
+
+func jobStatus(batchJob *batch.Job) string {
+	if condition := jobCondition(batchJob); condition != nil {
+		return string(condition.Type)
+	}
+
+	return fmt.Sprintf("Active, %v running, %v failed",
+		batchJob.Status.Active, batchJob.Status.Failed)
+}
@@ -0,0 +1,75 @@
+package runner_test
+
+import (
+	"bytes"
+	"testing"
+
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func Test_Execution_Handle_IdentifiesPod_WhenStarted(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, newTemplate("template"))
+	execution, err := jobRunner.Start(ctx, newJob())
+
+	assert.Nil(err)
+	assert.Equal("pod/namespace/test-job-00001", execution.Handle())
+}
+
+func Test_Runner_Wait_ReturnsExitCodeAndDeletesPod_WhenPodHasRun(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, terminatedPod("wait-me", 3))
+
+	exitCode, err := jobRunner.Wait(ctx, "pod/namespace/wait-me", newJob())
+
+	assert.Nil(err)
+	assert.Equal(3, exitCode)
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Logs_CopiesLogs_WhenPodHasRun(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, terminatedPod("log-me", 0))
+	out := new(bytes.Buffer)
+
+	assert.Nil(jobRunner.Logs(ctx, "pod/log-me", newJob(), out))
+	assert.Equal("fake logs", out.String())
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Len(pods.Items, 1)
+}
+
+func Test_Runner_Status_PrintsPhaseAndExitCode_WhenPodHasRun(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, terminatedPod("check-me", 1))
+	out := new(bytes.Buffer)
+
+	assert.Nil(jobRunner.Status(ctx, "pod/namespace/check-me", newJob(), out))
+	assert.Equal("pod/namespace/check-me Succeeded, exit code 1\n",
+		out.String())
+}
+
+func Test_Runner_Kill_DeletesPod_Normally(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, terminatedPod("kill-me", 0))
+
+	assert.Nil(jobRunner.Kill(ctx, "pod/namespace/kill-me", newJob()))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Wait_ReturnsError_WhenHandleIsInvalid(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+
+	_, err := jobRunner.Wait(ctx, "deployment/namespace/wait-me", newJob())
+
+	assert.EqualError(err, "invalid handle \"deployment/namespace/wait-me\", "+
+		"unsupported kind \"deployment\"")
+}
@@ -0,0 +1,99 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+
+	"github.com/ayashkov/k8srun/service"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"sigs.k8s.io/yaml"
+)
+
+const (
+	DRY_RUN_CLIENT = "client"
+	DRY_RUN_SERVER = "server"
+)
+
+const (
+	OUTPUT_YAML = "yaml"
+	OUTPUT_JSON = "json"
+)
+
+// dryRun prints the pod or the Job the job would create, validating it
+// with the API server first for the server dry run
+func (runner *defaultRunner) dryRun(ctx context.Context, job *Job,
+	out io.Writer) (int, error) {
+	if job.DryRun != DRY_RUN_CLIENT && job.DryRun != DRY_RUN_SERVER {
+		return -1, fmt.Errorf("unsupported dry run %q, expected %q or %q",
+			job.DryRun, DRY_RUN_CLIENT, DRY_RUN_SERVER)
+	}
+
+	template, err := runner.getPodTemplate(ctx, job)
+
+	if err != nil {
+		return -1, err
+	}
+
+	execution, err := runner.build(ctx, job, template)
+
+	if err != nil {
+		return -1, err
+	}
+
+	if job.DryRun == DRY_RUN_SERVER {
+		err = execution.create(ctx,
+			meta.CreateOptions{DryRun: []string{meta.DryRunAll}})
+
+		if err != nil {
+			return -1, err
+		}
+	}
+
+	var object runtime.Object = execution.Pod
+
+	if execution.BatchJob != nil {
+		execution.BatchJob.TypeMeta = meta.TypeMeta{
+			APIVersion: batch.SchemeGroupVersion.String(),
+			Kind:       "Job",
+		}
+		object = execution.BatchJob
+	} else {
+		execution.Pod.TypeMeta = meta.TypeMeta{
+			APIVersion: core.SchemeGroupVersion.String(),
+			Kind:       "Pod",
+		}
+	}
+
+	data, err := marshal(object, job.Output)
+
+	if err != nil {
+		return -1, err
+	}
+
+	if _, err = out.Write(data); err != nil {
+		return -1, err
+	}
+
+	service.Log.Infof("dry run (%v) of job %v succeeded", job.DryRun, job.Name)
+
+	return 0, nil
+}
+
+func marshal(object any, output string) ([]byte, error) {
+	switch output {
+	case "", OUTPUT_YAML:
+		return yaml.Marshal(object)
+	case OUTPUT_JSON:
+		data, err := json.MarshalIndent(object, "", "    ")
+
+		return append(data, '\n'), err
+	}
+
+	return nil, fmt.Errorf("unsupported output format %q, expected %q or %q",
+		output, OUTPUT_YAML, OUTPUT_JSON)
+}
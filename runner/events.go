@@ -0,0 +1,199 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/ayashkov/k8srun/service"
+	"github.com/sirupsen/logrus"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const (
+	EVENTS_NONE     = "none"
+	EVENTS_WARNINGS = "warnings"
+	EVENTS_ALL      = "all"
+)
+
+func eventsVerbosity(job *Job) (string, error) {
+	switch job.Events {
+	case "":
+		return EVENTS_ALL, nil
+	case EVENTS_NONE, EVENTS_WARNINGS, EVENTS_ALL:
+		return job.Events, nil
+	}
+
+	return "", fmt.Errorf("unsupported events verbosity %q, expected %q, "+
+		"%q or %q", job.Events, EVENTS_NONE, EVENTS_WARNINGS, EVENTS_ALL)
+}
+
+// streamEvents relays the events of the pod while it starts, so pending
+// scheduling, image pulls and mount failures are visible, until stopped
+func (execution *Execution) streamEvents(ctx context.Context,
+	pod *core.Pod) (stop func()) {
+	verbosity, _ := eventsVerbosity(execution.job())
+
+	if execution.Events == nil || verbosity == EVENTS_NONE {
+		return func() {}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	done := make(chan struct{})
+
+	go func() {
+		defer close(done)
+
+		for ctx.Err() == nil {
+			if err := execution.followEvents(ctx, pod); err != nil &&
+				ctx.Err() == nil {
+				service.Log.Debugf("error watching events of pod %q: %v",
+					pod.Name, err)
+			}
+
+			select {
+			case <-ctx.Done():
+			case <-time.After(rewatchDelay):
+			}
+		}
+	}()
+
+	return func() {
+		cancel()
+		<-done
+	}
+}
+
+func (execution *Execution) followEvents(ctx context.Context,
+	pod *core.Pod) error {
+	options := eventOptions(pod)
+	list, err := execution.Events.List(ctx, options)
+
+	if err != nil {
+		return err
+	}
+
+	for i := range list.Items {
+		execution.relayEvent(pod, &list.Items[i])
+	}
+
+	options.ResourceVersion = list.ResourceVersion
+
+	watcher, err := execution.Events.Watch(ctx, options)
+
+	if err != nil {
+		return err
+	}
+
+	defer watcher.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case change, ok := <-watcher.ResultChan():
+			if !ok {
+				return nil
+			}
+
+			if change.Type != watch.Added && change.Type != watch.Modified {
+				continue
+			}
+
+			if event, ok := change.Object.(*core.Event); ok {
+				execution.relayEvent(pod, event)
+			}
+		}
+	}
+}
+
+// logEvents relays the events of the pod not relayed yet, to explain its
+// failure
+func (execution *Execution) logEvents(ctx context.Context, pod *core.Pod) {
+	verbosity, _ := eventsVerbosity(execution.job())
+
+	if execution.Events == nil || pod == nil || verbosity == EVENTS_NONE {
+		return
+	}
+
+	list, err := execution.Events.List(ctx, eventOptions(pod))
+
+	if err != nil {
+		service.Log.Warnf("error listing events of pod %q: %v", pod.Name, err)
+
+		return
+	}
+
+	for i := range list.Items {
+		execution.relayEvent(pod, &list.Items[i])
+	}
+}
+
+// relayEvent logs the event once, and again each time it recurs, warnings
+// as warnings and the rest as information if the verbosity allows it
+func (execution *Execution) relayEvent(pod *core.Pod, event *core.Event) {
+	if event.InvolvedObject.Name != pod.Name {
+		return
+	}
+
+	verbosity, _ := eventsVerbosity(execution.job())
+	warning := event.Type == core.EventTypeWarning
+
+	if !warning && verbosity != EVENTS_ALL {
+		return
+	}
+
+	count := event.Count
+
+	if event.Series != nil {
+		count = event.Series.Count
+	}
+
+	if count < 1 {
+		count = 1
+	}
+
+	execution.mutex.Lock()
+
+	if execution.relayed == nil {
+		execution.relayed = map[string]int32{}
+	}
+
+	if execution.relayed[event.Name] >= count {
+		execution.mutex.Unlock()
+
+		return
+	}
+
+	execution.relayed[event.Name] = count
+	execution.mutex.Unlock()
+
+	entry := service.Log.WithFields(logrus.Fields{
+		"reason": event.Reason,
+		"count":  count,
+	})
+	message := fmt.Sprintf("pod %q: %v: %v", pod.Name, event.Reason,
+		event.Message)
+
+	if count > 1 {
+		message = fmt.Sprintf("%v (x%v)", message, count)
+	}
+
+	if warning {
+		entry.Warn(message)
+	} else {
+		entry.Info(message)
+	}
+}
+
+func eventOptions(pod *core.Pod) meta.ListOptions {
+	return meta.ListOptions{
+		FieldSelector: fields.Set{
+			"involvedObject.kind": "Pod",
+			"involvedObject.name": pod.Name,
+		}.String(),
+	}
+}
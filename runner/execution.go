@@ -2,116 +2,680 @@ package runner
 
 import (
 	"context"
+	"encoding/json"
 	"fmt"
 	"io"
+	"math"
+	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/ayashkov/k8srun/service"
+	batch "k8s.io/api/batch/v1"
 	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/wait"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	typedBatch "k8s.io/client-go/kubernetes/typed/batch/v1"
 	typedCore "k8s.io/client-go/kubernetes/typed/core/v1"
 )
 
+const drainTimeout = 5 * time.Second
+
+type podGoneError struct {
+	name string
+}
+
+func (err *podGoneError) Error() string {
+	return fmt.Sprintf("pod %q no longer exists", err.name)
+}
+
 type Execution struct {
-	Job  *Job
-	Pods typedCore.PodInterface
-	Pod  *core.Pod
+	Job      *Job
+	Pods     typedCore.PodInterface
+	Events   typedCore.EventInterface
+	Pod      *core.Pod
+	Jobs     typedBatch.JobInterface
+	BatchJob *batch.Job
+
+	keep        string
+	template    *core.PodTemplate
+	mutex       sync.Mutex
+	last        *core.Pod
+	deleted     time.Time
+	relayed     map[string]int32
+	killed      atomic.Bool
+	jobDeleted  atomic.Bool
+	succeeded   bool
+	once        sync.Once
+	group       *trackers
+	tracker     *tracker
+	jobTracker  *tracker
+	stop        context.CancelFunc
+	streams     sync.WaitGroup
+	stopStreams context.CancelFunc
 }
 
 func (execution *Execution) CopyLogs(ctx context.Context, dst io.Writer) error {
-	err := wait.PollImmediate(2*time.Second, time.Minute, func() (done bool, err error) {
-		pod, err := execution.Pods.Get(ctx, execution.Pod.Name,
-			meta.GetOptions{})
+	if execution.BatchJob != nil {
+		return execution.copyAttemptLogs(ctx, dst)
+	}
 
-		if err != nil {
-			return false, err
-		}
+	return execution.copyPodLogs(ctx, dst)
+}
+
+func (execution *Execution) WaitForCompletion(ctx context.Context) (int, error) {
+	if execution.BatchJob != nil {
+		return execution.waitForJob(ctx)
+	}
 
-		execution.Pod = pod
+	return execution.completePod(ctx)
+}
 
-		phase := pod.Status.Phase
+func (execution *Execution) create(ctx context.Context,
+	options meta.CreateOptions) error {
+	var err error
 
-		if phase == core.PodRunning || phase == core.PodSucceeded ||
-			phase == core.PodFailed {
-			return true, nil
+	if execution.BatchJob != nil {
+		execution.BatchJob, err = execution.Jobs.Create(ctx,
+			execution.BatchJob, options)
+
+		if err != nil {
+			return err
 		}
 
-		return false, nil
-	})
+		// the dry run logs its own outcome, nothing was created
+		if len(options.DryRun) > 0 {
+			return nil
+		}
 
-	if err != nil {
-		return err
+		logPod(execution.BatchJob.Namespace, "")
+		service.Log.Infof("created job %q in %q namespace",
+			execution.BatchJob.Name, execution.BatchJob.Namespace)
+
+		return nil
 	}
 
-	log, err := execution.Pods.GetLogs(execution.Pod.Name,
-		&core.PodLogOptions{Follow: true}).Stream(ctx)
+	execution.Pod, err = execution.Pods.Create(ctx, execution.Pod, options)
 
 	if err != nil {
 		return err
 	}
 
-	defer log.Close()
+	if len(options.DryRun) > 0 {
+		return nil
+	}
 
-	_, err = io.Copy(dst, log)
+	logPod(execution.Pod.Namespace, execution.Pod.Name)
+	service.Log.Infof("created pod %q in %q namespace",
+		execution.Pod.Name, execution.Pod.Namespace)
 
-	return err
+	return nil
 }
 
-func (execution *Execution) WaitForCompletion(ctx context.Context) (int, error) {
-	var exitCode int
+func (execution *Execution) copyPodLogs(ctx context.Context,
+	dst io.Writer) error {
+	pod := execution.current()
+	main := mainContainer(pod)
+	containers := containerNames(pod)
 
-	err := wait.PollImmediate(2*time.Second, time.Minute, func() (done bool, err error) {
-		pod, err := execution.Pods.Get(ctx, execution.Pod.Name,
-			meta.GetOptions{})
-
-		if err != nil {
-			return false, err
+	if len(containers) == 1 {
+		if err := execution.waitForStart(ctx, main); err != nil {
+			return err
 		}
 
-		execution.Pod = pod
+		return execution.copyContainerLogs(ctx, main, dst)
+	}
+
+	var mutex sync.Mutex
 
-		containerStatuses := pod.Status.ContainerStatuses
+	streamCtx, stopStreams := context.WithCancel(ctx)
 
-		if len(containerStatuses) == 0 {
-			return false, nil
+	execution.stopStreams = stopStreams
+
+	for _, name := range containers {
+		if name == main {
+			continue
 		}
 
-		terminated := containerStatuses[0].State.Terminated
+		writer := &lineWriter{mutex: &mutex, dst: dst, prefix: "[" + name + "] "}
+
+		execution.streams.Add(1)
+
+		go func(name string) {
+			defer execution.streams.Done()
+
+			err := execution.followContainer(streamCtx, name, writer)
+
+			if err != nil && streamCtx.Err() == nil {
+				service.Log.Warnf("error copying logs of container %q: %v",
+					name, err)
+			}
+		}(name)
+	}
+
+	if err := execution.waitForStart(ctx, main); err != nil {
+		return err
+	}
+
+	return execution.copyContainerLogs(ctx, main,
+		&lineWriter{mutex: &mutex, dst: dst, prefix: "[" + main + "] "})
+}
+
+func (execution *Execution) completePod(ctx context.Context) (int, error) {
+	var exitCode int
 
-		if terminated != nil {
+	main := mainContainer(execution.current())
+	timeout := execution.job().CompletionTimeout
+	err := execution.waitForPod(ctx, timeout, func(pod *core.Pod) (bool, error) {
+		if terminated := containerTerminated(pod, main); terminated != nil {
 			exitCode = int(terminated.ExitCode)
 
 			return true, nil
 		}
 
-		return false, nil
+		if failure := podFailure(pod); failure != nil {
+			return false, failure
+		}
+
+		return podFinished(pod), nil
 	})
 
+	if err == context.DeadlineExceeded {
+		return EXIT_COMPLETION_TIMEOUT, &ExitError{
+			Code: EXIT_COMPLETION_TIMEOUT,
+			Err: fmt.Errorf("pod %q did not complete within %v",
+				execution.current().Name, timeout),
+		}
+	}
+
 	if err != nil {
-		return 128, err
+		return EXIT_ERROR, execution.failed(ctx, err)
+	}
+
+	pod := execution.current()
+
+	if containerTerminated(pod, main) == nil {
+		return EXIT_ERROR, execution.failed(ctx, fmt.Errorf(
+			"pod %q finished without running container %q: %v",
+			pod.Name, main, pod.Status.Message))
+	}
+
+	execution.shutDownSidecars(ctx)
+
+	if failure := oomKilled(pod, main); failure != nil {
+		return failure.Code, execution.failed(ctx, failure)
 	}
 
 	return exitCode, nil
 }
 
+func (execution *Execution) Kill(ctx context.Context,
+	gracePeriod time.Duration) error {
+	pod := execution.current()
+
+	if execution.BatchJob != nil {
+		if err := execution.deleteBatchJob(ctx); err != nil {
+			return err
+		}
+	}
+
+	if pod == nil || execution.killed.Swap(true) {
+		return nil
+	}
+
+	seconds := int64(gracePeriod / time.Second)
+	err := execution.Pods.Delete(ctx, pod.Name,
+		meta.DeleteOptions{GracePeriodSeconds: &seconds})
+
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error killing pod %q in %q namespace: %w",
+			pod.Name, pod.Namespace, err)
+	}
+
+	execution.markDeleted()
+	service.Log.Infof("killing pod %q in %q namespace, grace period %v",
+		pod.Name, pod.Namespace, gracePeriod)
+
+	return nil
+}
+
 func (execution *Execution) Delete(ctx context.Context) error {
-	if execution.Pod == nil {
+	execution.release()
+
+	if execution.BatchJob != nil {
+		if err := execution.deleteBatchJob(ctx); err != nil {
+			return err
+		}
+
+		execution.setCurrent(nil)
+
 		return nil
 	}
 
-	err := execution.Pods.Delete(ctx, execution.Pod.Name,
-		meta.DeleteOptions{})
+	pod := execution.current()
 
-	if err != nil {
+	if pod == nil {
+		return nil
+	}
+
+	if execution.killed.Load() {
+		execution.setCurrent(nil)
+
+		return nil
+	}
+
+	err := execution.Pods.Delete(ctx, pod.Name, meta.DeleteOptions{})
+
+	if err != nil && !errors.IsNotFound(err) {
 		return fmt.Errorf("error deleting pod %q in %q namespace: %w",
-			execution.Pod.Name, execution.Pod.Namespace, err)
+			pod.Name, pod.Namespace, err)
 	}
 
+	execution.markDeleted()
 	service.Log.Infof("deleted pod %q in %q namespace",
-		execution.Pod.Name, execution.Pod.Namespace)
+		pod.Name, pod.Namespace)
+
+	execution.setCurrent(nil)
+
+	return nil
+}
+
+func (execution *Execution) waitForStart(ctx context.Context,
+	name string) error {
+	timeout := execution.job().StartTimeout
+	stopEvents := execution.streamEvents(ctx, execution.current())
+
+	defer stopEvents()
+
+	err := execution.waitForPod(ctx, timeout, func(pod *core.Pod) (bool, error) {
+		if containerStarted(pod, name) || podFinished(pod) {
+			return true, nil
+		}
+
+		if failure := podFailure(pod); failure != nil {
+			return false, failure
+		}
 
-	execution.Pod = nil
+		return false, nil
+	})
+
+	if err == context.DeadlineExceeded {
+		err = &ExitError{
+			Code: EXIT_START_TIMEOUT,
+			Err: fmt.Errorf("pod %q did not start within %v",
+				execution.current().Name, timeout),
+		}
+	}
+
+	if err != nil {
+		return execution.failed(ctx, err)
+	}
 
 	return nil
 }
+
+func (execution *Execution) followContainer(ctx context.Context, name string,
+	dst io.Writer) error {
+	err := execution.waitForPod(ctx, 0, func(pod *core.Pod) (bool, error) {
+		return containerStarted(pod, name) || podFinished(pod), nil
+	})
+
+	if err != nil {
+		return err
+	}
+
+	if !containerStarted(execution.current(), name) {
+		return nil
+	}
+
+	return execution.copyContainerLogs(ctx, name, dst)
+}
+
+// copyContainerLogs follows the log of the container until it terminates,
+// reconnecting when the stream is interrupted and resuming after the last
+// line copied, with a final catch-up read once the container has terminated
+func (execution *Execution) copyContainerLogs(ctx context.Context,
+	name string, dst io.Writer) error {
+	if !containerStarted(execution.current(), name) {
+		return nil
+	}
+
+	follower := &logFollower{dst: dst}
+	failures := 0
+
+	defer follower.flush()
+
+	for {
+		progress := follower.lines
+		err := execution.streamLogs(ctx, name, follower, true)
+
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+
+		if execution.waitForTermination(ctx, name) {
+			if follower.resumable() {
+				err = execution.streamLogs(ctx, name, follower, false)
+			}
+
+			if err != nil {
+				service.Log.Warnf("log of container %q may be incomplete: %v",
+					name, err)
+			}
+
+			return nil
+		}
+
+		if !follower.resumable() {
+			service.Log.Warnf("log of container %q may be incomplete, "+
+				"its log stream ended without timestamps to resume from", name)
+
+			return nil
+		}
+
+		if follower.lines == progress {
+			failures++
+		} else {
+			failures = 0
+		}
+
+		if failures >= maxLogReconnects {
+			service.Log.Warnf("log of container %q may be incomplete, "+
+				"giving up after %v reconnects: %v", name, failures, err)
+
+			return nil
+		}
+
+		service.Log.Debugf("log stream of container %q was interrupted, "+
+			"reconnecting: %v", name, err)
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-time.After(time.Duration(failures) * logReconnectDelay):
+		}
+	}
+}
+
+func (execution *Execution) streamLogs(ctx context.Context, name string,
+	follower *logFollower, follow bool) error {
+	options := &core.PodLogOptions{
+		Container:  name,
+		Follow:     follow,
+		Timestamps: true,
+	}
+
+	if follower.resumable() {
+		options.SinceTime = &meta.Time{Time: follower.last}
+	}
+
+	log, err := execution.Pods.GetLogs(execution.current().Name,
+		options).Stream(ctx)
+
+	if err != nil {
+		return err
+	}
+
+	defer log.Close()
+
+	return follower.copy(log)
+}
+
+// waitForTermination reports whether the container has terminated, giving
+// the pod status a moment to catch up with the end of the log stream
+func (execution *Execution) waitForTermination(ctx context.Context,
+	name string) bool {
+	err := execution.waitForPod(ctx, logReconnectDelay,
+		func(pod *core.Pod) (bool, error) {
+			return containerTerminated(pod, name) != nil || podFinished(pod),
+				nil
+		})
+
+	return err != context.DeadlineExceeded
+}
+
+// shutDownSidecars makes the pod complete once its main container has
+// terminated by lowering its activeDeadlineSeconds, so the kubelet stops
+// the remaining containers, then waits for their logs to drain. The pod of
+// a Job whose main container has succeeded is terminated by suspending the
+// Job instead, as the Job controller would retry a pod failed by its deadline
+func (execution *Execution) shutDownSidecars(ctx context.Context) {
+	pod := execution.current()
+	names := sidecars(pod)
+
+	if len(names) == 0 || podFinished(pod) {
+		execution.drainStreams()
+
+		return
+	}
+
+	service.Log.Infof("terminating sidecar containers %v of pod %q",
+		names, pod.Name)
+
+	var err error
+
+	terminated := containerTerminated(pod, mainContainer(pod))
+
+	if execution.BatchJob != nil && terminated != nil &&
+		terminated.ExitCode == 0 {
+		err = execution.suspendBatchJob(ctx)
+	} else {
+		err = execution.expirePod(ctx, pod)
+	}
+
+	if err != nil {
+		service.Log.Warnf("error terminating sidecar containers of pod %q: %v",
+			pod.Name, err)
+	} else if err := execution.waitForPod(ctx,
+		execution.job().GracePeriod+killMargin,
+		func(pod *core.Pod) (bool, error) {
+			return podFinished(pod), nil
+		}); err != nil {
+		// the Job controller deletes the pods of a suspended Job
+		if _, gone := err.(*podGoneError); !gone {
+			service.Log.Warnf("sidecar containers of pod %q did not "+
+				"terminate: %v", pod.Name, err)
+		}
+	}
+
+	execution.drainStreams()
+}
+
+// expirePod lowers the activeDeadlineSeconds of the pod to the time it has
+// been running, so the kubelet stops its containers
+func (execution *Execution) expirePod(ctx context.Context,
+	pod *core.Pod) error {
+	deadline := int64(1)
+
+	if pod.Status.StartTime != nil {
+		elapsed := time.Since(pod.Status.StartTime.Time).Seconds()
+
+		deadline = int64(math.Max(1, math.Ceil(elapsed)))
+	}
+
+	patch, _ := json.Marshal(map[string]any{
+		"spec": map[string]any{"activeDeadlineSeconds": deadline},
+	})
+
+	_, err := execution.Pods.Patch(ctx, pod.Name, types.StrategicMergePatchType,
+		patch, meta.PatchOptions{})
+
+	return err
+}
+
+// failed logs the warning events of the pod to explain err, unless err is
+// caused by ctx being done
+func (execution *Execution) failed(ctx context.Context, err error) error {
+	if ctx.Err() == nil {
+		execution.logEvents(ctx, execution.current())
+	}
+
+	return err
+}
+
+func (execution *Execution) drainStreams() {
+	done := make(chan struct{})
+
+	go func() {
+		execution.streams.Wait()
+		close(done)
+	}()
+
+	select {
+	case <-done:
+	case <-time.After(drainTimeout):
+		if execution.stopStreams != nil {
+			execution.stopStreams()
+		}
+
+		<-done
+	}
+}
+
+// release stops following the logs and tracking the pod
+func (execution *Execution) release() {
+	if execution.stopStreams != nil {
+		execution.stopStreams()
+	}
+
+	if execution.stop != nil {
+		execution.stop()
+	}
+}
+
+func (execution *Execution) job() *Job {
+	if execution.Job == nil {
+		return &Job{}
+	}
+
+	return execution.Job
+}
+
+func (execution *Execution) current() *core.Pod {
+	execution.mutex.Lock()
+	defer execution.mutex.Unlock()
+
+	return execution.Pod
+}
+
+func (execution *Execution) setCurrent(pod *core.Pod) {
+	execution.mutex.Lock()
+	defer execution.mutex.Unlock()
+
+	if pod != nil {
+		execution.last = pod
+	}
+
+	execution.Pod = pod
+}
+
+// lastPod returns the last known state of the pod, even once it is deleted
+func (execution *Execution) lastPod() *core.Pod {
+	execution.mutex.Lock()
+	defer execution.mutex.Unlock()
+
+	if execution.last == nil {
+		return execution.Pod
+	}
+
+	return execution.last
+}
+
+func (execution *Execution) markDeleted() {
+	execution.mutex.Lock()
+	defer execution.mutex.Unlock()
+
+	if execution.deleted.IsZero() {
+		execution.deleted = time.Now()
+	}
+}
+
+func (execution *Execution) deletedAt() time.Time {
+	execution.mutex.Lock()
+	defer execution.mutex.Unlock()
+
+	return execution.deleted
+}
+
+func (execution *Execution) track() *tracker {
+	execution.once.Do(func() {
+		var ctx context.Context
+
+		ctx, execution.stop = context.WithCancel(context.Background())
+		execution.group = newTrackers()
+
+		options := meta.ListOptions{}
+
+		if execution.BatchJob != nil {
+			options.LabelSelector = labels.Set{
+				"controller-uid": string(execution.BatchJob.UID),
+			}.String()
+			execution.jobTracker = execution.group.newTracker(
+				func(ctx context.Context,
+					options meta.ListOptions) (runtime.Object, error) {
+					return execution.Jobs.List(ctx, options)
+				},
+				func(ctx context.Context,
+					options meta.ListOptions) (watch.Interface, error) {
+					return execution.Jobs.Watch(ctx, options)
+				},
+				meta.ListOptions{
+					FieldSelector: fields.OneTermEqualSelector("metadata.name",
+						execution.BatchJob.Name).String(),
+				})
+
+			go execution.jobTracker.run(ctx)
+		} else {
+			options.FieldSelector = fields.OneTermEqualSelector(
+				"metadata.name", execution.current().Name).String()
+		}
+
+		execution.tracker = execution.group.newTracker(
+			func(ctx context.Context,
+				options meta.ListOptions) (runtime.Object, error) {
+				return execution.Pods.List(ctx, options)
+			},
+			func(ctx context.Context,
+				options meta.ListOptions) (watch.Interface, error) {
+				return execution.Pods.Watch(ctx, options)
+			},
+			options)
+
+		go execution.tracker.run(ctx)
+	})
+
+	return execution.tracker
+}
+
+func (execution *Execution) waitForPod(ctx context.Context,
+	timeout time.Duration, condition func(pod *core.Pod) (bool, error)) error {
+	name := execution.current().Name
+
+	if timeout > 0 {
+		var cancel context.CancelFunc
+
+		ctx, cancel = context.WithTimeout(ctx, timeout)
+
+		defer cancel()
+	}
+
+	return execution.track().wait(ctx,
+		func(objects map[string]runtime.Object) (bool, error) {
+			object, ok := objects[name]
+
+			if !ok {
+				return false, &podGoneError{name: name}
+			}
+
+			pod := object.(*core.Pod)
+
+			execution.setCurrent(pod)
+
+			return condition(pod)
+		})
+}
@@ -0,0 +1,585 @@
+package runner_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ayashkov/k8srun/mock"
+	"github.com/ayashkov/k8srun/runner"
+	"github.com/golang/mock/gomock"
+	"github.com/sirupsen/logrus"
+	batch "k8s.io/api/batch/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/watch"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func newPod(name string, phase core.PodPhase) *core.Pod {
+	pod := &core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:            name,
+			Namespace:       "namespace",
+			ResourceVersion: "1",
+		},
+		Spec: core.PodSpec{
+			Containers: []core.Container{{Name: "job"}},
+		},
+		Status: core.PodStatus{Phase: phase},
+	}
+
+	if phase == core.PodRunning {
+		pod.Status.ContainerStatuses = []core.ContainerStatus{{
+			Name: "job",
+			State: core.ContainerState{
+				Running: &core.ContainerStateRunning{},
+			},
+		}}
+	}
+
+	return pod
+}
+
+func terminatedPod(name string, exitCode int32) *core.Pod {
+	pod := newPod(name, core.PodSucceeded)
+
+	pod.Status.ContainerStatuses = []core.ContainerStatus{{
+		Name: "job",
+		State: core.ContainerState{
+			Terminated: &core.ContainerStateTerminated{ExitCode: exitCode},
+		},
+	}}
+
+	return pod
+}
+
+func podList(version string, pods ...*core.Pod) *core.PodList {
+	list := &core.PodList{ListMeta: meta.ListMeta{ResourceVersion: version}}
+
+	for _, pod := range pods {
+		list.Items = append(list.Items, *pod)
+	}
+
+	return list
+}
+
+func watchOptions(name string, version string) meta.ListOptions {
+	return meta.ListOptions{
+		FieldSelector:       "metadata.name=" + name,
+		ResourceVersion:     version,
+		AllowWatchBookmarks: true,
+	}
+}
+
+func Test_Execution_WaitForCompletion_ReturnsExitCode_WhenWatchReportsTermination(t *testing.T) {
+	assert := setUp(t)
+	pods := mock.NewMockPodInterface(gomock.NewController(t))
+	watcher := watch.NewFake()
+	execution := runner.Execution{
+		Pod:  newPod("wait-me", core.PodPending),
+		Pods: pods,
+	}
+
+	defer execution.Delete(ctx)
+
+	pods.EXPECT().
+		List(gomock.Any(), meta.ListOptions{
+			FieldSelector: "metadata.name=wait-me",
+		}).
+		Return(podList("10", newPod("wait-me", core.PodRunning)), nil)
+	pods.EXPECT().
+		Watch(gomock.Any(), watchOptions("wait-me", "10")).
+		Return(watcher, nil)
+	pods.EXPECT().
+		Delete(gomock.Any(), "wait-me", gomock.Any())
+
+	go watcher.Modify(terminatedPod("wait-me", 42))
+
+	exitCode, err := execution.WaitForCompletion(ctx)
+
+	assert.Nil(err)
+	assert.Equal(42, exitCode)
+}
+
+func Test_Execution_WaitForCompletion_Relists_WhenResourceVersionIsTooOld(t *testing.T) {
+	assert := setUp(t)
+	pods := mock.NewMockPodInterface(gomock.NewController(t))
+	watcher := watch.NewFake()
+	execution := runner.Execution{
+		Pod:  newPod("wait-me", core.PodPending),
+		Pods: pods,
+	}
+
+	defer execution.Delete(ctx)
+
+	gomock.InOrder(
+		pods.EXPECT().
+			List(gomock.Any(), gomock.Any()).
+			Return(podList("10", newPod("wait-me", core.PodRunning)), nil),
+		pods.EXPECT().
+			Watch(gomock.Any(), watchOptions("wait-me", "10")).
+			Return(watcher, nil),
+		pods.EXPECT().
+			List(gomock.Any(), gomock.Any()).
+			Return(podList("20", terminatedPod("wait-me", 7)), nil),
+	)
+	pods.EXPECT().
+		Watch(gomock.Any(), watchOptions("wait-me", "20")).
+		Return(watch.NewFake(), nil).
+		AnyTimes()
+	pods.EXPECT().
+		Delete(gomock.Any(), "wait-me", gomock.Any())
+
+	go watcher.Error(&errors.NewResourceExpired("too old resource version").ErrStatus)
+
+	exitCode, err := execution.WaitForCompletion(ctx)
+
+	assert.Nil(err)
+	assert.Equal(7, exitCode)
+}
+
+func Test_Execution_WaitForCompletion_ResumesWatch_WhenWatchFails(t *testing.T) {
+	assert := setUp(t)
+	pods := mock.NewMockPodInterface(gomock.NewController(t))
+	watcher := watch.NewFake()
+	resumed := watch.NewFake()
+	running := newPod("wait-me", core.PodRunning)
+	execution := runner.Execution{
+		Pod:  newPod("wait-me", core.PodPending),
+		Pods: pods,
+	}
+
+	defer execution.Delete(ctx)
+
+	running.ResourceVersion = "11"
+
+	pods.EXPECT().
+		List(gomock.Any(), gomock.Any()).
+		Return(podList("10", newPod("wait-me", core.PodPending)), nil)
+	gomock.InOrder(
+		pods.EXPECT().
+			Watch(gomock.Any(), watchOptions("wait-me", "10")).
+			Return(watcher, nil),
+		pods.EXPECT().
+			Watch(gomock.Any(), watchOptions("wait-me", "11")).
+			Return(nil, errors.NewInternalError(fmt.Errorf("etcd timeout"))),
+		pods.EXPECT().
+			Watch(gomock.Any(), watchOptions("wait-me", "11")).
+			Return(resumed, nil),
+	)
+	pods.EXPECT().
+		Delete(gomock.Any(), "wait-me", gomock.Any())
+
+	go func() {
+		watcher.Modify(running)
+		watcher.Error(&errors.NewServiceUnavailable("unavailable").ErrStatus)
+		resumed.Modify(terminatedPod("wait-me", 5))
+	}()
+
+	exitCode, err := execution.WaitForCompletion(ctx)
+
+	assert.Nil(err)
+	assert.Equal(5, exitCode)
+	assert.Equal(logrus.WarnLevel, logger.LastEntry().Level)
+}
+
+func Test_Execution_WaitForCompletion_ReturnsError_WhenPodIsDeleted(t *testing.T) {
+	assert := setUp(t)
+	pods := mock.NewMockPodInterface(gomock.NewController(t))
+	watcher := watch.NewFake()
+	execution := runner.Execution{
+		Pod:  newPod("wait-me", core.PodPending),
+		Pods: pods,
+	}
+
+	pods.EXPECT().
+		List(gomock.Any(), gomock.Any()).
+		Return(podList("10", newPod("wait-me", core.PodRunning)), nil)
+	pods.EXPECT().
+		Watch(gomock.Any(), gomock.Any()).
+		Return(watcher, nil)
+
+	go watcher.Delete(newPod("wait-me", core.PodRunning))
+
+	_, err := execution.WaitForCompletion(ctx)
+
+	assert.EqualError(err, "pod \"wait-me\" no longer exists")
+}
+
+func Test_Execution_CopyLogs_CopiesLogs_WhenContainerHasRun(t *testing.T) {
+	assert := setUp(t)
+	pod := terminatedPod("log-me", 0)
+	execution := runner.Execution{
+		Pod:  pod,
+		Pods: fake.NewSimpleClientset(pod).CoreV1().Pods("namespace"),
+	}
+	out := new(bytes.Buffer)
+
+	defer execution.Delete(ctx)
+
+	assert.Nil(execution.CopyLogs(ctx, out))
+	assert.Equal("fake logs", out.String())
+}
+
+func Test_Execution_CopyLogs_ReturnsStartTimeout_WhenPodDoesNotStart(t *testing.T) {
+	assert := setUp(t)
+	pod := newPod("slow-pod", core.PodPending)
+	execution := runner.Execution{
+		Job:  &runner.Job{StartTimeout: 10 * time.Millisecond},
+		Pod:  pod,
+		Pods: fake.NewSimpleClientset(pod).CoreV1().Pods("namespace"),
+	}
+
+	defer execution.Delete(ctx)
+
+	err := execution.CopyLogs(ctx, new(bytes.Buffer))
+
+	assert.EqualError(err, "pod \"slow-pod\" did not start within 10ms")
+	assert.Equal(runner.EXIT_START_TIMEOUT, runner.ExitCode(err))
+}
+
+func Test_Execution_WaitForCompletion_ReturnsCompletionTimeout_WhenPodDoesNotComplete(t *testing.T) {
+	assert := setUp(t)
+	pod := newPod("slow-pod", core.PodRunning)
+	execution := runner.Execution{
+		Job:  &runner.Job{CompletionTimeout: 10 * time.Millisecond},
+		Pod:  pod,
+		Pods: fake.NewSimpleClientset(pod).CoreV1().Pods("namespace"),
+	}
+
+	defer execution.Delete(ctx)
+
+	exitCode, err := execution.WaitForCompletion(ctx)
+
+	assert.EqualError(err, "pod \"slow-pod\" did not complete within 10ms")
+	assert.Equal(runner.EXIT_COMPLETION_TIMEOUT, exitCode)
+	assert.Equal(runner.EXIT_COMPLETION_TIMEOUT, runner.ExitCode(err))
+}
+
+func withSidecars(pod *core.Pod, state core.ContainerState,
+	names ...string) *core.Pod {
+	for _, name := range names {
+		pod.Spec.Containers = append(pod.Spec.Containers,
+			core.Container{Name: name})
+		pod.Status.ContainerStatuses = append(pod.Status.ContainerStatuses,
+			core.ContainerStatus{Name: name, State: state})
+	}
+
+	return pod
+}
+
+func Test_Execution_CopyLogs_PrefixesLines_WhenPodHasSeveralContainers(t *testing.T) {
+	assert := setUp(t)
+	terminated := core.ContainerState{
+		Terminated: &core.ContainerStateTerminated{},
+	}
+	pod := withSidecars(terminatedPod("log-me", 0), terminated, "proxy")
+
+	pod.Spec.InitContainers = []core.Container{{Name: "init"}}
+	pod.Status.InitContainerStatuses = []core.ContainerStatus{{
+		Name:  "init",
+		State: terminated,
+	}}
+
+	execution := runner.Execution{
+		Pod:  pod,
+		Pods: fake.NewSimpleClientset(pod).CoreV1().Pods("namespace"),
+	}
+	out := new(bytes.Buffer)
+
+	defer execution.Delete(ctx)
+
+	assert.Nil(execution.CopyLogs(ctx, out))
+
+	exitCode, err := execution.WaitForCompletion(ctx)
+
+	assert.Nil(err)
+	assert.Equal(0, exitCode)
+	assert.Contains(out.String(), "[job] fake logs\n")
+	assert.Contains(out.String(), "[init] fake logs\n")
+	assert.Contains(out.String(), "[proxy] fake logs\n")
+}
+
+func Test_Execution_WaitForCompletion_TerminatesSidecars_WhenMainContainerTerminates(t *testing.T) {
+	assert := setUp(t)
+	pods := mock.NewMockPodInterface(gomock.NewController(t))
+	watcher := watch.NewFake()
+	running := core.ContainerState{Running: &core.ContainerStateRunning{}}
+	pod := withSidecars(terminatedPod("wait-me", 3), running, "proxy")
+	execution := runner.Execution{
+		Pod:  pod,
+		Pods: pods,
+	}
+
+	pod.Status.Phase = core.PodRunning
+
+	pods.EXPECT().
+		List(gomock.Any(), gomock.Any()).
+		Return(podList("10", pod), nil)
+	pods.EXPECT().
+		Watch(gomock.Any(), gomock.Any()).
+		Return(watcher, nil)
+	pods.EXPECT().
+		Patch(gomock.Any(), "wait-me", types.StrategicMergePatchType,
+			[]byte(`{"spec":{"activeDeadlineSeconds":1}}`), gomock.Any()).
+		DoAndReturn(func(_, _, _, _, _ any, _ ...string) (*core.Pod, error) {
+			finished := pod.DeepCopy()
+
+			finished.Status.Phase = core.PodFailed
+
+			go watcher.Modify(finished)
+
+			return finished, nil
+		})
+
+	exitCode, err := execution.WaitForCompletion(ctx)
+
+	assert.Nil(err)
+	assert.Equal(3, exitCode)
+	assert.Equal(core.PodFailed, execution.Pod.Status.Phase)
+}
+
+func Test_Execution_ReportsFailure_WhenPodCannotRun(t *testing.T) {
+	waiting := func(reason string) func(pod *core.Pod) {
+		return func(pod *core.Pod) {
+			pod.Status.ContainerStatuses = []core.ContainerStatus{{
+				Name: "job",
+				State: core.ContainerState{
+					Waiting: &core.ContainerStateWaiting{
+						Reason:  reason,
+						Message: "details",
+					},
+				},
+			}}
+		}
+	}
+	tests := []struct {
+		name    string
+		prepare func(pod *core.Pod)
+		code    int
+		message string
+	}{
+		{
+			"ErrImagePull", waiting("ErrImagePull"), runner.EXIT_IMAGE_PULL,
+			"container \"job\" of pod \"fail-me\" failed: ErrImagePull: details",
+		},
+		{
+			"ImagePullBackOff", waiting("ImagePullBackOff"),
+			runner.EXIT_IMAGE_PULL,
+			"container \"job\" of pod \"fail-me\" failed: ImagePullBackOff: details",
+		},
+		{
+			"CreateContainerConfigError",
+			waiting("CreateContainerConfigError"), runner.EXIT_CONTAINER_CONFIG,
+			"container \"job\" of pod \"fail-me\" failed: CreateContainerConfigError: details",
+		},
+		{
+			"Unschedulable", func(pod *core.Pod) {
+				pod.Status.Conditions = []core.PodCondition{{
+					Type:    core.PodScheduled,
+					Status:  core.ConditionFalse,
+					Reason:  core.PodReasonUnschedulable,
+					Message: "0/3 nodes are available",
+				}}
+			}, runner.EXIT_UNSCHEDULABLE,
+			"pod \"fail-me\" cannot be scheduled: 0/3 nodes are available",
+		},
+		{
+			"Evicted", func(pod *core.Pod) {
+				pod.Status.Phase = core.PodFailed
+				pod.Status.Reason = "Evicted"
+				pod.Status.Message = "low on memory"
+			}, runner.EXIT_EVICTED,
+			"pod \"fail-me\" was evicted: low on memory",
+		},
+		{
+			"OOMKilled", func(pod *core.Pod) {
+				pod.Status.Phase = core.PodFailed
+				pod.Status.ContainerStatuses = []core.ContainerStatus{{
+					Name: "job",
+					State: core.ContainerState{
+						Terminated: &core.ContainerStateTerminated{
+							ExitCode: 137,
+							Reason:   "OOMKilled",
+						},
+					},
+				}}
+			}, runner.EXIT_OOM_KILLED,
+			"container \"job\" of pod \"fail-me\" was killed for running out of memory",
+		},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			assert := setUp(t)
+			pod := newPod("fail-me", core.PodPending)
+
+			test.prepare(pod)
+
+			clientset := fake.NewSimpleClientset(pod, &core.Event{
+				ObjectMeta: meta.ObjectMeta{
+					Name:      "fail-me.1",
+					Namespace: "namespace",
+				},
+				InvolvedObject: core.ObjectReference{
+					Kind: "Pod",
+					Name: "fail-me",
+				},
+				Type:    core.EventTypeWarning,
+				Reason:  "Failed",
+				Message: "something went wrong",
+			})
+			execution := runner.Execution{
+				Job:    &runner.Job{},
+				Pod:    pod,
+				Pods:   clientset.CoreV1().Pods("namespace"),
+				Events: clientset.CoreV1().Events("namespace"),
+			}
+
+			defer execution.Delete(ctx)
+
+			err := execution.CopyLogs(ctx, new(bytes.Buffer))
+
+			if err == nil {
+				_, err = execution.WaitForCompletion(ctx)
+			}
+
+			assert.EqualError(err, test.message)
+			assert.Equal(test.code, runner.ExitCode(err))
+			assert.Equal(logrus.WarnLevel, logger.Entries[0].Level)
+			assert.Equal(
+				"pod \"fail-me\": Failed: something went wrong",
+				logger.Entries[0].Message)
+		})
+	}
+}
+
+func podEvent(name string, reason string, eventType string,
+	count int32) *core.Event {
+	return &core.Event{
+		ObjectMeta: meta.ObjectMeta{Name: name, Namespace: "namespace"},
+		InvolvedObject: core.ObjectReference{
+			Kind: "Pod",
+			Name: "pending",
+		},
+		Type:    eventType,
+		Reason:  reason,
+		Message: "pulling image \"alpine\"",
+		Count:   count,
+	}
+}
+
+func Test_Execution_CopyLogs_RelaysEvents_WhilePodStarts(t *testing.T) {
+	assert := setUp(t)
+	pod := newPod("pending", core.PodPending)
+	clientset := fake.NewSimpleClientset(pod,
+		podEvent("pending.1", "Pulling", core.EventTypeNormal, 1))
+	execution := runner.Execution{
+		Job:    &runner.Job{StartTimeout: 200 * time.Millisecond},
+		Pod:    pod,
+		Pods:   clientset.CoreV1().Pods("namespace"),
+		Events: clientset.CoreV1().Events("namespace"),
+	}
+
+	time.AfterFunc(50*time.Millisecond, func() {
+		clientset.CoreV1().Events("namespace").Update(ctx,
+			podEvent("pending.1", "Pulling", core.EventTypeNormal, 2),
+			meta.UpdateOptions{})
+	})
+
+	err := execution.CopyLogs(ctx, new(bytes.Buffer))
+
+	assert.Equal(runner.EXIT_START_TIMEOUT, runner.ExitCode(err))
+	assert.Len(logger.Entries, 2)
+	assert.Equal(logrus.InfoLevel, logger.Entries[0].Level)
+	assert.Equal("pod \"pending\": Pulling: pulling image \"alpine\"",
+		logger.Entries[0].Message)
+	assert.Equal("pod \"pending\": Pulling: pulling image \"alpine\" (x2)",
+		logger.Entries[1].Message)
+	assert.Equal("Pulling", logger.Entries[1].Data["reason"])
+}
+
+func Test_Execution_CopyLogs_RelaysOnlyWarnings_WhenEventsAreWarnings(t *testing.T) {
+	assert := setUp(t)
+	pod := newPod("pending", core.PodPending)
+	clientset := fake.NewSimpleClientset(pod,
+		podEvent("pending.1", "Pulling", core.EventTypeNormal, 1),
+		podEvent("pending.2", "FailedMount", core.EventTypeWarning, 1))
+	execution := runner.Execution{
+		Job: &runner.Job{
+			StartTimeout: 100 * time.Millisecond,
+			Events:       runner.EVENTS_WARNINGS,
+		},
+		Pod:    pod,
+		Pods:   clientset.CoreV1().Pods("namespace"),
+		Events: clientset.CoreV1().Events("namespace"),
+	}
+
+	err := execution.CopyLogs(ctx, new(bytes.Buffer))
+
+	assert.Equal(runner.EXIT_START_TIMEOUT, runner.ExitCode(err))
+	assert.Len(logger.Entries, 1)
+	assert.Equal(logrus.WarnLevel, logger.Entries[0].Level)
+	assert.Equal("FailedMount", logger.Entries[0].Data["reason"])
+}
+
+func Test_Execution_SuspendsJob_WhenMainContainerOfAttemptSucceeds(t *testing.T) {
+	assert := setUp(t)
+	backoffLimit := int32(2)
+	batchJob := &batch.Job{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      "test-job",
+			Namespace: "namespace",
+			UID:       "uid-1",
+		},
+		Spec: batch.JobSpec{BackoffLimit: &backoffLimit},
+	}
+	running := core.ContainerState{Running: &core.ContainerStateRunning{}}
+	pod := withSidecars(terminatedPod("test-job-1", 0), running, "proxy")
+
+	pod.Labels = map[string]string{"controller-uid": "uid-1"}
+	pod.Status.Phase = core.PodRunning
+
+	clientset := fake.NewSimpleClientset(batchJob, pod)
+
+	// the Job controller deletes the pods of a suspended Job
+	clientset.PrependReactor("patch", "jobs",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			go clientset.CoreV1().Pods("namespace").Delete(ctx, pod.Name,
+				meta.DeleteOptions{})
+
+			return false, nil, nil
+		})
+
+	execution := runner.Execution{
+		Job:      &runner.Job{},
+		Pods:     clientset.CoreV1().Pods("namespace"),
+		Jobs:     clientset.BatchV1().Jobs("namespace"),
+		BatchJob: batchJob,
+	}
+
+	defer execution.Delete(ctx)
+
+	assert.Nil(execution.CopyLogs(ctx, new(bytes.Buffer)))
+
+	exitCode, err := execution.WaitForCompletion(ctx)
+
+	assert.Nil(err)
+	assert.Equal(0, exitCode)
+
+	suspended, _ := clientset.BatchV1().Jobs("namespace").Get(ctx,
+		"test-job", meta.GetOptions{})
+
+	assert.True(*suspended.Spec.Suspend)
+
+	for _, action := range clientset.Actions() {
+		assert.False(action.Matches("patch", "pods"),
+			"the pod of the Job must not be failed by its deadline")
+	}
+}
@@ -0,0 +1,87 @@
+package runner
+
+import (
+	"errors"
+)
+
+// Exit codes reported by k8srun itself. The 2xx codes are chosen outside
+// of the range normally used by the workload so AutoSys operators can tell
+// a k8srun problem from a failure of the job. EXIT_ERROR and EXIT_KILLED
+// follow the shell convention instead, 143 is also the code of a container
+// terminated by SIGTERM, so it cannot tell a killed run from a workload
+// that was terminated on its own.
+const (
+	// EXIT_ERROR is reported for any error without a dedicated code.
+	EXIT_ERROR = 128
+
+	// EXIT_KILLED is reported when k8srun was terminated by a signal
+	// (e.g. AutoSys KILLJOB) and the pod was deleted, as 128 + SIGTERM.
+	EXIT_KILLED = 143
+
+	// EXIT_START_TIMEOUT is reported when the pod did not start running
+	// within the start timeout.
+	EXIT_START_TIMEOUT = 201
+
+	// EXIT_RUN_TIMEOUT is reported when the job did not finish before its
+	// overall deadline and the pod was deleted.
+	EXIT_RUN_TIMEOUT = 202
+
+	// EXIT_COMPLETION_TIMEOUT is reported when the container did not
+	// terminate within the completion timeout after its log stream ended.
+	EXIT_COMPLETION_TIMEOUT = 203
+
+	// EXIT_QUEUE_TIMEOUT is reported when the job did not get a free slot
+	// of its concurrency limits within the queue timeout.
+	EXIT_QUEUE_TIMEOUT = 204
+
+	// EXIT_IMAGE_PULL is reported when an image of the pod could not be
+	// pulled (ErrImagePull, ImagePullBackOff, InvalidImageName).
+	EXIT_IMAGE_PULL = 210
+
+	// EXIT_CONTAINER_CONFIG is reported when a container could not be
+	// created, e.g. because of a missing ConfigMap or Secret
+	// (CreateContainerConfigError, CreateContainerError).
+	EXIT_CONTAINER_CONFIG = 211
+
+	// EXIT_UNSCHEDULABLE is reported when the scheduler could not place
+	// the pod on any node.
+	EXIT_UNSCHEDULABLE = 212
+
+	// EXIT_OOM_KILLED is reported when the main container was killed for
+	// exceeding its memory limit.
+	EXIT_OOM_KILLED = 213
+
+	// EXIT_EVICTED is reported when the pod was evicted from its node.
+	EXIT_EVICTED = 214
+
+	// EXIT_LOCKED is reported when another run of the same job holds its
+	// lock and the lock policy is to fail.
+	EXIT_LOCKED = 220
+
+	// EXIT_SKIPPED is reported when another run of the same job holds its
+	// lock and the lock policy is to skip the run.
+	EXIT_SKIPPED = 221
+)
+
+type ExitError struct {
+	Code int
+	Err  error
+}
+
+func (err *ExitError) Error() string {
+	return err.Err.Error()
+}
+
+func (err *ExitError) Unwrap() error {
+	return err.Err
+}
+
+func ExitCode(err error) int {
+	var exitErr *ExitError
+
+	if errors.As(err, &exitErr) {
+		return exitErr.Code
+	}
+
+	return EXIT_ERROR
+}
@@ -0,0 +1,155 @@
+package runner
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	core "k8s.io/api/core/v1"
+)
+
+// EXPAND is the template annotation enabling the expansion of the text
+// templates in the fields of the pod and in the arguments
+const EXPAND = "k8srun.yashkov.org/expand"
+
+const dateLayout = "2006-01-02"
+
+// expansion is the data available to the text templates
+type expansion struct {
+	Instance  string
+	Job       string
+	Run       string
+	Machine   string
+	Date      string
+	Namespace string
+	Template  string
+	Env       map[string]string
+}
+
+var expansionFuncs = template.FuncMap{
+	"lower":   strings.ToLower,
+	"upper":   strings.ToUpper,
+	"trim":    strings.TrimSpace,
+	"replace": strings.ReplaceAll,
+	"date": func(layout string, date string) (string, error) {
+		parsed, err := time.Parse(dateLayout, date)
+
+		if err != nil {
+			return "", fmt.Errorf("invalid date %q, expected %v", date,
+				dateLayout)
+		}
+
+		return parsed.Format(layout), nil
+	},
+}
+
+// expandPod expands the text templates in the string fields of the pod,
+// arguments included, with the metadata of the job
+func expandPod(pod *core.Pod, template *core.PodTemplate, job *Job) error {
+	if template.Annotations[EXPAND] != "true" {
+		return nil
+	}
+
+	data := &expansion{
+		Instance:  job.Instance,
+		Job:       job.Name,
+		Run:       job.RunNumber,
+		Machine:   job.Machine,
+		Date:      job.Date,
+		Namespace: template.Namespace,
+		Template:  template.Name,
+		Env:       map[string]string{},
+	}
+
+	for name, value := range job.Env {
+		data.Env[name] = value
+	}
+
+	data.Env["AUTOSERV"] = job.Instance
+	data.Env["AUTO_JOB_NAME"] = job.Name
+
+	if job.RunNumber != "" {
+		data.Env["AUTORUN"] = job.RunNumber
+	}
+
+	if job.Machine != "" {
+		data.Env["AUTO_MACHINE"] = job.Machine
+	}
+
+	document, err := json.Marshal(pod)
+
+	if err != nil {
+		return err
+	}
+
+	var value any
+
+	if err := json.Unmarshal(document, &value); err != nil {
+		return err
+	}
+
+	if value, err = expandValue(value, data); err != nil {
+		return err
+	}
+
+	if document, err = json.Marshal(value); err != nil {
+		return err
+	}
+
+	expanded := core.Pod{}
+
+	if err := json.Unmarshal(document, &expanded); err != nil {
+		return fmt.Errorf("invalid expanded pod: %w", err)
+	}
+
+	*pod = expanded
+
+	return nil
+}
+
+func expandValue(value any, data *expansion) (any, error) {
+	var err error
+
+	switch value := value.(type) {
+	case string:
+		return expandString(value, data)
+	case map[string]any:
+		for key := range value {
+			if value[key], err = expandValue(value[key], data); err != nil {
+				return nil, err
+			}
+		}
+	case []any:
+		for i := range value {
+			if value[i], err = expandValue(value[i], data); err != nil {
+				return nil, err
+			}
+		}
+	}
+
+	return value, nil
+}
+
+func expandString(text string, data *expansion) (string, error) {
+	if !strings.Contains(text, "{{") {
+		return text, nil
+	}
+
+	parsed, err := template.New("field").Funcs(expansionFuncs).
+		Option("missingkey=error").Parse(text)
+
+	if err != nil {
+		return "", fmt.Errorf("invalid template %q: %w", text, err)
+	}
+
+	var expanded bytes.Buffer
+
+	if err := parsed.Execute(&expanded, data); err != nil {
+		return "", fmt.Errorf("error expanding %q: %w", text, err)
+	}
+
+	return expanded.String(), nil
+}
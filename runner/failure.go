@@ -0,0 +1,78 @@
+package runner
+
+import (
+	"fmt"
+
+	core "k8s.io/api/core/v1"
+)
+
+var waitingFailures = map[string]int{
+	"ErrImagePull":               EXIT_IMAGE_PULL,
+	"ImagePullBackOff":           EXIT_IMAGE_PULL,
+	"InvalidImageName":           EXIT_IMAGE_PULL,
+	"ErrImageNeverPull":          EXIT_IMAGE_PULL,
+	"CreateContainerConfigError": EXIT_CONTAINER_CONFIG,
+	"CreateContainerError":       EXIT_CONTAINER_CONFIG,
+}
+
+// podFailure detects pod states that will not recover by themselves, so
+// k8srun can fail fast instead of waiting for a timeout
+func podFailure(pod *core.Pod) *ExitError {
+	if pod.Status.Reason == "Evicted" {
+		return &ExitError{
+			Code: EXIT_EVICTED,
+			Err: fmt.Errorf("pod %q was evicted: %v", pod.Name,
+				pod.Status.Message),
+		}
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core.PodScheduled &&
+			condition.Status == core.ConditionFalse &&
+			condition.Reason == core.PodReasonUnschedulable {
+			return &ExitError{
+				Code: EXIT_UNSCHEDULABLE,
+				Err: fmt.Errorf("pod %q cannot be scheduled: %v", pod.Name,
+					condition.Message),
+			}
+		}
+	}
+
+	for _, statuses := range [][]core.ContainerStatus{
+		pod.Status.InitContainerStatuses,
+		pod.Status.ContainerStatuses,
+	} {
+		for _, status := range statuses {
+			waiting := status.State.Waiting
+
+			if waiting == nil {
+				continue
+			}
+
+			if code, ok := waitingFailures[waiting.Reason]; ok {
+				return &ExitError{
+					Code: code,
+					Err: fmt.Errorf("container %q of pod %q failed: %v: %v",
+						status.Name, pod.Name, waiting.Reason, waiting.Message),
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+func oomKilled(pod *core.Pod, container string) *ExitError {
+	terminated := containerTerminated(pod, container)
+
+	if terminated == nil || terminated.Reason != "OOMKilled" {
+		return nil
+	}
+
+	return &ExitError{
+		Code: EXIT_OOM_KILLED,
+		Err: fmt.Errorf(
+			"container %q of pod %q was killed for running out of memory",
+			container, pod.Name),
+	}
+}
@@ -0,0 +1,278 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+
+	"github.com/ayashkov/k8srun/service"
+	coordination "k8s.io/api/coordination/v1"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+)
+
+// DETACHED is the annotation of the pods started by the start subcommand,
+// no k8srun process follows them until they are waited for
+const DETACHED = "k8srun.yashkov.org/detached"
+
+const heartbeatAttempts = 3
+
+const heartbeatRetry = time.Second
+
+// GCOptions scope the reaping of orphaned pods
+type GCOptions struct {
+	Namespace string
+	Instance  string
+	MinAge    time.Duration
+	DryRun    bool
+}
+
+// orphan is a pod, or the Job owning it, to delete
+type orphan struct {
+	kind   string
+	name   string
+	reason string
+}
+
+// heartbeat holds the Lease telling the pod or the Job of the execution is
+// still followed by a live k8srun process, without it gc would reap them
+func (runner *defaultRunner) heartbeat(ctx context.Context, job *Job,
+	execution *Execution) (*lease, error) {
+	var name string
+
+	if execution.BatchJob != nil {
+		name = execution.BatchJob.Name
+	} else {
+		name = execution.current().Name
+	}
+
+	heartbeat := runner.newLease(job, heartbeatName(name))
+
+	for attempt := 1; ; attempt++ {
+		holder, err := heartbeat.acquire(ctx)
+
+		if err == nil && holder == "" {
+			break
+		}
+
+		if err == nil {
+			err = fmt.Errorf("held by %v", holder)
+		}
+
+		if attempt == heartbeatAttempts {
+			return nil, fmt.Errorf("error acquiring heartbeat %q: %w",
+				heartbeat.name, err)
+		}
+
+		service.Log.Warnf("error acquiring heartbeat %q, retrying: %v",
+			heartbeat.name, err)
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(heartbeatRetry):
+		}
+	}
+
+	heartbeat.hold()
+
+	return heartbeat, nil
+}
+
+func heartbeatName(name string) string {
+	return "k8srun-run-" + name
+}
+
+// GC deletes the pods left behind by k8srun runs: expired retained pods,
+// pods of runs without a heartbeat that have terminated or were abandoned
+func (runner *defaultRunner) GC(ctx context.Context, options *GCOptions,
+	out io.Writer) error {
+	namespace := options.Namespace
+
+	if namespace == "" {
+		namespace = runner.namespace
+	}
+
+	selector := labels.Set{MANAGED_BY: MANAGER}
+
+	if options.Instance != "" {
+		selector[INSTANCE] = labelValue(options.Instance)
+	}
+
+	pods, err := runner.clentset.CoreV1().Pods(namespace).List(ctx,
+		meta.ListOptions{LabelSelector: selector.String()})
+
+	if err != nil {
+		return err
+	}
+
+	leases, err := runner.clentset.CoordinationV1().Leases(namespace).List(ctx,
+		meta.ListOptions{})
+
+	if err != nil {
+		return err
+	}
+
+	heartbeats := map[string]*coordination.Lease{}
+
+	for i := range leases.Items {
+		heartbeats[leases.Items[i].Name] = &leases.Items[i]
+	}
+
+	now := time.Now()
+	orphans := []orphan{}
+	seen := map[string]bool{}
+	owners := map[string]meta.Object{}
+
+	for i := range pods.Items {
+		pod := &pods.Items[i]
+
+		if pod.DeletionTimestamp != nil || (options.Instance != "" &&
+			!strings.EqualFold(pod.Annotations[INSTANCE], options.Instance)) {
+			continue
+		}
+
+		target := orphan{kind: BACKEND_POD, name: pod.Name}
+		var retention meta.Object = pod
+
+		if owner := meta.GetControllerOf(pod); owner != nil &&
+			owner.Kind == "Job" {
+			target = orphan{kind: BACKEND_JOB, name: owner.Name}
+
+			// a retained Job carries the retention, not its pods
+			if retention, err = runner.owner(ctx, namespace, owner.Name,
+				owners); err != nil {
+				return err
+			}
+		}
+
+		target.reason = orphanReason(pod, retention,
+			heartbeats[heartbeatName(target.name)], now, options.MinAge)
+
+		if target.reason == "" || seen[target.kind+"/"+target.name] {
+			continue
+		}
+
+		seen[target.kind+"/"+target.name] = true
+		orphans = append(orphans, target)
+	}
+
+	for _, target := range orphans {
+		if options.DryRun {
+			fmt.Fprintf(out, "would delete %v %q in %q namespace: %v\n",
+				target.kind, target.name, namespace, target.reason)
+
+			continue
+		}
+
+		if err := runner.deleteOrphan(ctx, namespace, target); err != nil {
+			return err
+		}
+
+		fmt.Fprintf(out, "deleted %v %q in %q namespace: %v\n", target.kind,
+			target.name, namespace, target.reason)
+	}
+
+	return nil
+}
+
+// owner returns the Job owning a pod, or nil when it is already gone,
+// caching the Jobs by name
+func (runner *defaultRunner) owner(ctx context.Context, namespace string,
+	name string, owners map[string]meta.Object) (meta.Object, error) {
+	if owner, ok := owners[name]; ok {
+		return owner, nil
+	}
+
+	batchJob, err := runner.clentset.BatchV1().Jobs(namespace).Get(ctx, name,
+		meta.GetOptions{})
+
+	if errors.IsNotFound(err) {
+		owners[name] = nil
+
+		return nil, nil
+	}
+
+	if err != nil {
+		return nil, err
+	}
+
+	owners[name] = batchJob
+
+	return batchJob, nil
+}
+
+func (runner *defaultRunner) deleteOrphan(ctx context.Context,
+	namespace string, target orphan) error {
+	var err error
+
+	if target.kind == BACKEND_JOB {
+		propagation := meta.DeletePropagationBackground
+
+		err = runner.clentset.BatchV1().Jobs(namespace).Delete(ctx,
+			target.name, meta.DeleteOptions{PropagationPolicy: &propagation})
+	} else {
+		err = runner.clentset.CoreV1().Pods(namespace).Delete(ctx,
+			target.name, meta.DeleteOptions{})
+	}
+
+	if err != nil && !errors.IsNotFound(err) {
+		return fmt.Errorf("error deleting %v %q in %q namespace: %w",
+			target.kind, target.name, namespace, err)
+	}
+
+	err = runner.clentset.CoordinationV1().Leases(namespace).Delete(ctx,
+		heartbeatName(target.name), meta.DeleteOptions{})
+
+	if err != nil && !errors.IsNotFound(err) {
+		service.Log.Warnf("error deleting heartbeat of %v %q: %v",
+			target.kind, target.name, err)
+	}
+
+	return nil
+}
+
+// orphanReason tells why the pod should be deleted, or returns an empty
+// string when it should be kept, retention is the pod or its Job
+func orphanReason(pod *core.Pod, retention meta.Object,
+	heartbeat *coordination.Lease, now time.Time, minAge time.Duration) string {
+	if retention == nil {
+		retention = pod
+	}
+
+	if retention.GetLabels()[RETAINED] == "true" {
+		if expired(retention, now) {
+			return "its retention has expired"
+		}
+
+		return ""
+	}
+
+	if heartbeat != nil && leaseHolder(heartbeat) != "" {
+		return ""
+	}
+
+	if now.Sub(pod.CreationTimestamp.Time) < minAge {
+		return ""
+	}
+
+	finished := podFinished(pod)
+
+	if pod.Annotations[DETACHED] == "true" {
+		if finished {
+			return "its detached run has finished"
+		}
+
+		return ""
+	}
+
+	if finished {
+		return "it has terminated and its run is gone"
+	}
+
+	return "its run has no heartbeat"
+}
@@ -0,0 +1,242 @@
+package runner_test
+
+import (
+	"bytes"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/ayashkov/k8srun/runner"
+	batch "k8s.io/api/batch/v1"
+	coordination "k8s.io/api/coordination/v1"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func managedPod(name string, instance string, phase core.PodPhase,
+	age time.Duration) *core.Pod {
+	pod := newPod(name, phase)
+
+	pod.CreationTimestamp = meta.NewTime(time.Now().Add(-age))
+	pod.Labels = map[string]string{
+		runner.MANAGED_BY: runner.MANAGER,
+		runner.INSTANCE:   instance,
+	}
+	pod.Annotations = map[string]string{runner.INSTANCE: instance}
+
+	return pod
+}
+
+func heartbeat(name string) *coordination.Lease {
+	lease := heldLease("ACE/TEST_JOB/1", time.Now())
+
+	lease.Name = "k8srun-run-" + name
+
+	return lease
+}
+
+func Test_Runner_GC_DeletesOrphanedPods_Normally(t *testing.T) {
+	assert := setUp(t)
+	detached := managedPod("detached", "ace", core.PodRunning, time.Hour)
+
+	detached.Annotations[runner.DETACHED] = "true"
+
+	jobRunner, clientset := newRunner(t,
+		managedPod("terminated", "ace", core.PodFailed, time.Hour),
+		managedPod("abandoned", "ace", core.PodRunning, time.Hour),
+		managedPod("alive", "ace", core.PodRunning, time.Hour),
+		managedPod("young", "ace", core.PodRunning, time.Minute),
+		detached,
+		heartbeat("alive"))
+	out := new(bytes.Buffer)
+
+	assert.Nil(jobRunner.GC(ctx, &runner.GCOptions{MinAge: 10 * time.Minute},
+		out))
+	assert.Contains(out.String(), "deleted pod \"terminated\" in "+
+		"\"namespace\" namespace: it has terminated and its run is gone\n")
+	assert.Contains(out.String(), "deleted pod \"abandoned\" in "+
+		"\"namespace\" namespace: its run has no heartbeat\n")
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+	names := []string{}
+
+	for _, pod := range pods.Items {
+		names = append(names, pod.Name)
+	}
+
+	assert.ElementsMatch([]string{"alive", "young", "detached"}, names)
+}
+
+func Test_Runner_GC_OnlyPrintsOrphans_WhenDryRun(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t,
+		managedPod("terminated", "ace", core.PodSucceeded, time.Hour))
+	out := new(bytes.Buffer)
+
+	assert.Nil(jobRunner.GC(ctx, &runner.GCOptions{DryRun: true}, out))
+	assert.Equal("would delete pod \"terminated\" in \"namespace\" "+
+		"namespace: it has terminated and its run is gone\n", out.String())
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Len(pods.Items, 1)
+}
+
+func Test_Runner_GC_KeepsPodsOfOtherInstances_WhenInstanceIsGiven(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t,
+		managedPod("ace", "ace", core.PodSucceeded, time.Hour),
+		managedPod("prd", "prd", core.PodSucceeded, time.Hour))
+
+	assert.Nil(jobRunner.GC(ctx, &runner.GCOptions{Instance: "ACE"},
+		new(bytes.Buffer)))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Len(pods.Items, 1)
+	assert.Equal("prd", pods.Items[0].Name)
+}
+
+func Test_Runner_Run_HoldsHeartbeat_WhileRunning(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.Timeout = 200 * time.Millisecond
+
+	time.AfterFunc(100*time.Millisecond, func() {
+		_, err := clientset.CoordinationV1().Leases("namespace").
+			Get(ctx, "k8srun-run-test-job-00001", meta.GetOptions{})
+
+		assert.Nil(err)
+	})
+
+	_, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(runner.EXIT_RUN_TIMEOUT, runner.ExitCode(err))
+
+	leases, _ := clientset.CoordinationV1().Leases("namespace").
+		List(ctx, meta.ListOptions{})
+
+	assert.Empty(leases.Items)
+}
+
+func Test_Runner_Run_HoldsHeartbeatOfJob_WhenJobBackend(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.BACKEND] = runner.BACKEND_JOB
+
+	jobRunner, clientset := newRunner(t, template)
+	created := []string{}
+
+	clientset.PrependReactor("create", "leases",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			lease := action.(k8sTesting.CreateAction).GetObject().(*coordination.Lease)
+
+			created = append(created, lease.Name)
+
+			return false, nil, nil
+		})
+	// the Job controller runs the attempt of the Job
+	time.AfterFunc(20*time.Millisecond, func() {
+		attempt := newPod("test-job-00001-x", core.PodSucceeded)
+
+		attempt.Labels = map[string]string{"controller-uid": "uid-1"}
+		attempt.Status.ContainerStatuses = []core.ContainerStatus{{
+			Name: "job",
+			State: core.ContainerState{
+				Terminated: &core.ContainerStateTerminated{},
+			},
+		}}
+
+		_, err := clientset.CoreV1().Pods("namespace").Create(ctx, attempt,
+			meta.CreateOptions{})
+
+		assert.Nil(err)
+	})
+
+	exitCode, err := jobRunner.Run(ctx, newJob(), new(bytes.Buffer))
+
+	assert.Nil(err)
+	assert.Equal(0, exitCode)
+	assert.Contains(created, "k8srun-run-test-job-00001")
+
+	leases, _ := clientset.CoordinationV1().Leases("namespace").
+		List(ctx, meta.ListOptions{})
+
+	assert.Empty(leases.Items)
+}
+
+func Test_Runner_GC_KeepsRetainedJob_UntilItExpires(t *testing.T) {
+	assert := setUp(t)
+	retained := &batch.Job{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      "retained",
+			Namespace: "namespace",
+			Labels: map[string]string{
+				runner.MANAGED_BY: runner.MANAGER,
+				runner.RETAINED:   "true",
+			},
+			Annotations: map[string]string{
+				runner.EXPIRES: time.Now().Add(24 * time.Hour).UTC().
+					Format(time.RFC3339),
+			},
+		},
+	}
+	expired := retained.DeepCopy()
+
+	expired.Name = "expired"
+	expired.Annotations[runner.EXPIRES] = time.Now().Add(-time.Hour).UTC().
+		Format(time.RFC3339)
+
+	jobPod := func(owner string) *core.Pod {
+		pod := managedPod(owner+"-pod", "ace", core.PodSucceeded, time.Hour)
+
+		pod.OwnerReferences = []meta.OwnerReference{*meta.NewControllerRef(
+			&batch.Job{ObjectMeta: meta.ObjectMeta{Name: owner}},
+			batch.SchemeGroupVersion.WithKind("Job"))}
+
+		return pod
+	}
+
+	jobRunner, clientset := newRunner(t, retained, expired,
+		jobPod("retained"), jobPod("expired"))
+	out := new(bytes.Buffer)
+
+	assert.Nil(jobRunner.GC(ctx, &runner.GCOptions{}, out))
+	assert.Equal("deleted job \"expired\" in \"namespace\" namespace: "+
+		"its retention has expired\n", out.String())
+
+	jobs, _ := clientset.BatchV1().Jobs("namespace").List(ctx,
+		meta.ListOptions{})
+
+	assert.Len(jobs.Items, 1)
+	assert.Equal("retained", jobs.Items[0].Name)
+}
+
+func Test_Runner_Run_KillsPod_WhenHeartbeatCannotBeAcquired(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	attempts := 0
+
+	clientset.PrependReactor("create", "leases",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			attempts++
+
+			return true, nil, fmt.Errorf("leases are forbidden")
+		})
+
+	exitCode, err := jobRunner.Run(ctx, newJob(), new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.ErrorContains(err, "leases are forbidden")
+	assert.Equal(runner.EXIT_ERROR, runner.ExitCode(err))
+	assert.Equal(3, attempts)
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
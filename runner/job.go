@@ -1,9 +1,42 @@
 package runner
 
+import (
+	"time"
+)
+
 type Job struct {
-	Instance  string
-	Name      string
-	Namespace string
-	Template  string
-	Args      []string
+	Instance    string
+	Name        string
+	RunNumber   string
+	Date        string
+	Machine     string
+	Env         map[string]string
+	Namespace   string
+	Template    string
+	Args        []string
+	Backend     string
+	DryRun      string
+	Fresh       bool
+	Detached    bool
+	Lock        string
+	Events      string
+	Output      string
+	Report      string
+	MetricsDir  string
+	MetricsURL  string
+	KeepPod     string
+	Retention   time.Duration
+	GracePeriod time.Duration
+
+	TemplateKind      string
+	TemplateFile      string
+	TemplateConfigMap string
+	Overrides         Overrides
+	PatchFiles        []string
+	PatchType         string
+
+	QueueTimeout      time.Duration
+	StartTimeout      time.Duration
+	Timeout           time.Duration
+	CompletionTimeout time.Duration
 }
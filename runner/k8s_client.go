@@ -1,6 +1,7 @@
 package runner
 
 import (
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
 	"k8s.io/client-go/tools/clientcmd"
@@ -10,6 +11,7 @@ type K8sClient interface {
 	NewClientConfig(loader clientcmd.ClientConfigLoader,
 		overrides *clientcmd.ConfigOverrides) clientcmd.ClientConfig
 	NewClientset(c *rest.Config) (kubernetes.Interface, error)
+	NewDynamicClient(c *rest.Config) (dynamic.Interface, error)
 }
 
 type defaultK8sClient struct{}
@@ -23,3 +25,7 @@ func (defaultK8sClient) NewClientConfig(loader clientcmd.ClientConfigLoader,
 func (defaultK8sClient) NewClientset(c *rest.Config) (kubernetes.Interface, error) {
 	return kubernetes.NewForConfig(c)
 }
+
+func (defaultK8sClient) NewDynamicClient(c *rest.Config) (dynamic.Interface, error) {
+	return dynamic.NewForConfig(c)
+}
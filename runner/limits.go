@@ -0,0 +1,193 @@
+package runner
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/ayashkov/k8srun/service"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+// CONCURRENCY is the template annotation capping the number of runs of
+// the template active at the same time
+const CONCURRENCY = "k8srun.yashkov.org/concurrency"
+
+// CONCURRENCY_CONFIG_MAP is the ConfigMap capping the number of runs active
+// at the same time per AutoSys instance, keyed by the instance name
+const CONCURRENCY_CONFIG_MAP = "k8srun-concurrency"
+
+const slotRetry = 5 * time.Second
+
+// limit is a cap on the number of active runs within a scope, each run
+// holds one of its slot Leases while it is active
+type limit struct {
+	scope string
+	slots int
+}
+
+// acquireSlots waits for a free slot in every concurrency limit applying
+// to the job and returns the Leases holding them. The waiting runs poll the
+// slots, so the queue is best-effort: a run may overtake the runs waiting
+// longer than it
+func (runner *defaultRunner) acquireSlots(ctx context.Context, job *Job,
+	template *Template) ([]*lease, error) {
+	limits, err := runner.limits(ctx, job, template)
+
+	if err != nil || len(limits) == 0 {
+		return nil, err
+	}
+
+	queueCtx := ctx
+
+	if job.QueueTimeout > 0 {
+		var cancel context.CancelFunc
+
+		queueCtx, cancel = context.WithTimeout(ctx, job.QueueTimeout)
+
+		defer cancel()
+	}
+
+	held := []*lease{}
+
+	for _, limit := range limits {
+		slot, err := runner.acquireSlot(queueCtx, job, limit)
+
+		if err == nil {
+			held = append(held, slot)
+
+			continue
+		}
+
+		releaseSlots(held)
+
+		if ctx.Err() != nil {
+			return nil, &ExitError{
+				Code: EXIT_KILLED,
+				Err: fmt.Errorf("job %v was killed waiting in the queue",
+					job.Name),
+			}
+		}
+
+		if queueCtx.Err() != nil {
+			return nil, &ExitError{
+				Code: EXIT_QUEUE_TIMEOUT,
+				Err: fmt.Errorf("job %v did not get a free slot of %v "+
+					"within %v", job.Name, limit.scope, job.QueueTimeout),
+			}
+		}
+
+		return nil, err
+	}
+
+	return held, nil
+}
+
+func (runner *defaultRunner) acquireSlot(ctx context.Context, job *Job,
+	limit limit) (*lease, error) {
+	logged := false
+
+	for {
+		for i := 0; i < limit.slots; i++ {
+			slot := runner.newLease(job, slotName(limit.scope, i))
+			holder, err := slot.acquire(ctx)
+
+			if err != nil {
+				return nil, fmt.Errorf("error acquiring slot %q: %w",
+					slot.name, err)
+			}
+
+			if holder == "" {
+				slot.hold()
+
+				return slot, nil
+			}
+		}
+
+		if !logged {
+			service.Log.Infof("all %v slots of %v are taken, job %v is "+
+				"waiting in the queue", limit.slots, limit.scope, job.Name)
+			logged = true
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(slotRetry):
+		}
+	}
+}
+
+func releaseSlots(slots []*lease) {
+	for _, slot := range slots {
+		slot.release()
+	}
+}
+
+// limits returns the concurrency limits of the instance, from the
+// ConfigMap, and of the template, from its annotation
+func (runner *defaultRunner) limits(ctx context.Context, job *Job,
+	template *Template) ([]limit, error) {
+	limits := []limit{}
+	instance := strings.ToLower(job.Instance)
+	namespace := runner.jobNamespace(job)
+	config, err := runner.clentset.CoreV1().ConfigMaps(namespace).
+		Get(ctx, CONCURRENCY_CONFIG_MAP, meta.GetOptions{})
+
+	if err != nil && !errors.IsNotFound(err) {
+		service.Log.Warnf("error reading concurrency limits from config map "+
+			"%q: %v", CONCURRENCY_CONFIG_MAP, err)
+	}
+
+	if err == nil {
+		if text, ok := config.Data[instance]; ok {
+			slots, err := concurrency(text)
+
+			if err != nil {
+				return nil, fmt.Errorf("config map %v key %v %w",
+					CONCURRENCY_CONFIG_MAP, instance, err)
+			}
+
+			limits = append(limits, limit{
+				scope: "instance " + instance,
+				slots: slots,
+			})
+		}
+	}
+
+	if text, ok := template.Annotations[CONCURRENCY]; ok {
+		slots, err := concurrency(text)
+
+		if err != nil {
+			return nil, fmt.Errorf("template annotation %v %w", CONCURRENCY,
+				err)
+		}
+
+		limits = append(limits, limit{
+			scope: "template " + template.Name,
+			slots: slots,
+		})
+	}
+
+	return limits, nil
+}
+
+func concurrency(text string) (int, error) {
+	slots, err := strconv.Atoi(strings.TrimSpace(text))
+
+	if err != nil || slots < 1 {
+		return 0, fmt.Errorf("must be a positive integer, got %q", text)
+	}
+
+	return slots, nil
+}
+
+func slotName(scope string, i int) string {
+	sum := sha256.Sum256([]byte(scope))
+
+	return fmt.Sprintf("k8srun-slot-%x-%v", sum[:10], i)
+}
@@ -0,0 +1,304 @@
+package runner
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/ayashkov/k8srun/service"
+	coordination "k8s.io/api/coordination/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/uuid"
+	typedCoordination "k8s.io/client-go/kubernetes/typed/coordination/v1"
+)
+
+const (
+	LOCK_FAIL = "fail"
+	LOCK_WAIT = "wait"
+	LOCK_SKIP = "skip"
+)
+
+const leaseDuration = 30 * time.Second
+
+const leaseRenewal = 10 * time.Second
+
+// lease is the lock of a job, held while its run is active
+type lease struct {
+	leases   typedCoordination.LeaseInterface
+	name     string
+	identity string
+	current  *coordination.Lease
+	stop     context.CancelFunc
+	done     chan struct{}
+
+	// lost is closed when another run has taken the Lease over, lostTo
+	lost   chan struct{}
+	lostTo string
+}
+
+// lock acquires the Lease of the job according to its lock policy and
+// keeps renewing it until it is released
+func (runner *defaultRunner) lock(ctx context.Context, job *Job) (*lease,
+	error) {
+	switch job.Lock {
+	case LOCK_FAIL, LOCK_WAIT, LOCK_SKIP:
+	default:
+		return nil, fmt.Errorf("unsupported lock policy %q, expected %q, "+
+			"%q or %q", job.Lock, LOCK_FAIL, LOCK_WAIT, LOCK_SKIP)
+	}
+
+	lease := runner.newLease(job, leaseName(job))
+
+	for {
+		holder, err := lease.acquire(ctx)
+
+		if err != nil {
+			return nil, fmt.Errorf("error acquiring lock %q: %w",
+				lease.name, err)
+		}
+
+		if holder == "" {
+			break
+		}
+
+		switch job.Lock {
+		case LOCK_FAIL:
+			return nil, &ExitError{
+				Code: EXIT_LOCKED,
+				Err: fmt.Errorf("job %v is locked by %v", job.Name,
+					holder),
+			}
+		case LOCK_SKIP:
+			return nil, &ExitError{
+				Code: EXIT_SKIPPED,
+				Err: fmt.Errorf("job %v is locked by %v, skipping the run",
+					job.Name, holder),
+			}
+		}
+
+		service.Log.Infof("job %v is locked by %v, waiting", job.Name, holder)
+
+		select {
+		case <-ctx.Done():
+			return nil, &ExitError{
+				Code: EXIT_KILLED,
+				Err: fmt.Errorf("job %v was killed waiting for its lock",
+					job.Name),
+			}
+		case <-time.After(leaseRenewal):
+		}
+	}
+
+	lease.hold()
+
+	return lease, nil
+}
+
+func (runner *defaultRunner) newLease(job *Job, name string) *lease {
+	return &lease{
+		leases: runner.clentset.CoordinationV1().
+			Leases(runner.jobNamespace(job)),
+		name:     name,
+		identity: holderIdentity(job),
+		lost:     make(chan struct{}),
+	}
+}
+
+// acquire takes the Lease over unless it is held by another run and has
+// not expired, in which case it returns the identity of its holder
+func (lease *lease) acquire(ctx context.Context) (string, error) {
+	now := meta.NewMicroTime(time.Now())
+	seconds := int32(leaseDuration / time.Second)
+	current, err := lease.leases.Get(ctx, lease.name, meta.GetOptions{})
+
+	if errors.IsNotFound(err) {
+		lease.current, err = lease.leases.Create(ctx, &coordination.Lease{
+			ObjectMeta: meta.ObjectMeta{
+				Name:   lease.name,
+				Labels: map[string]string{MANAGED_BY: MANAGER},
+			},
+			Spec: coordination.LeaseSpec{
+				HolderIdentity:       &lease.identity,
+				LeaseDurationSeconds: &seconds,
+				AcquireTime:          &now,
+				RenewTime:            &now,
+			},
+		}, meta.CreateOptions{})
+
+		if errors.IsAlreadyExists(err) {
+			return "another run", nil
+		}
+
+		return "", err
+	}
+
+	if err != nil {
+		return "", err
+	}
+
+	if holder := leaseHolder(current); holder != "" &&
+		holder != lease.identity {
+		return holder, nil
+	}
+
+	current.Spec.HolderIdentity = &lease.identity
+	current.Spec.LeaseDurationSeconds = &seconds
+	current.Spec.AcquireTime = &now
+	current.Spec.RenewTime = &now
+	lease.current, err = lease.leases.Update(ctx, current, meta.UpdateOptions{})
+
+	if errors.IsConflict(err) {
+		return "another run", nil
+	}
+
+	return "", err
+}
+
+// hold keeps renewing the acquired Lease until it is released
+func (lease *lease) hold() {
+	ctx, stop := context.WithCancel(context.Background())
+
+	lease.stop = stop
+	lease.done = make(chan struct{})
+
+	go lease.renew(ctx)
+}
+
+func (lease *lease) renew(ctx context.Context) {
+	defer close(lease.done)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-time.After(leaseRenewal):
+		}
+
+		renewed := lease.current.DeepCopy()
+		now := meta.NewMicroTime(time.Now())
+
+		renewed.Spec.RenewTime = &now
+		renewed, err := lease.leases.Update(ctx, renewed, meta.UpdateOptions{})
+
+		if errors.IsConflict(err) {
+			if lease.refresh(ctx) {
+				return
+			}
+
+			continue
+		}
+
+		if err != nil {
+			if ctx.Err() == nil {
+				service.Log.Warnf("error renewing lock %q: %v", lease.name, err)
+			}
+
+			continue
+		}
+
+		lease.current = renewed
+	}
+}
+
+// refresh reads the Lease again after a conflicting renewal and tells
+// whether another run has taken it over, closing lost if so
+func (lease *lease) refresh(ctx context.Context) bool {
+	current, err := lease.leases.Get(ctx, lease.name, meta.GetOptions{})
+
+	if errors.IsNotFound(err) {
+		lease.lostTo = "nobody"
+		close(lease.lost)
+
+		return true
+	}
+
+	if err != nil {
+		if ctx.Err() == nil {
+			service.Log.Warnf("error renewing lock %q: %v", lease.name, err)
+		}
+
+		return false
+	}
+
+	if current.Spec.HolderIdentity == nil ||
+		*current.Spec.HolderIdentity != lease.identity {
+		lease.lostTo = leaseHolder(current)
+
+		if lease.lostTo == "" {
+			lease.lostTo = "another run"
+		}
+
+		close(lease.lost)
+
+		return true
+	}
+
+	lease.current = current
+
+	return false
+}
+
+// release stops renewing the Lease and deletes it, unless another run has
+// taken it over in the meantime
+func (lease *lease) release() {
+	lease.stop()
+	<-lease.done
+
+	select {
+	case <-lease.lost:
+		return
+	default:
+	}
+
+	version := lease.current.ResourceVersion
+	err := lease.leases.Delete(context.Background(), lease.name,
+		meta.DeleteOptions{
+			Preconditions: &meta.Preconditions{ResourceVersion: &version},
+		})
+
+	if err != nil && !errors.IsNotFound(err) && !errors.IsConflict(err) {
+		service.Log.Warnf("error releasing lock %q: %v", lease.name, err)
+	}
+}
+
+// leaseHolder returns the holder of the Lease, or an empty string when it
+// is free or has expired
+func leaseHolder(lease *coordination.Lease) string {
+	spec := lease.Spec
+
+	if spec.HolderIdentity == nil || spec.RenewTime == nil ||
+		spec.LeaseDurationSeconds == nil {
+		return ""
+	}
+
+	expires := spec.RenewTime.Add(
+		time.Duration(*spec.LeaseDurationSeconds) * time.Second)
+
+	if time.Now().After(expires) {
+		return ""
+	}
+
+	return *spec.HolderIdentity
+}
+
+func leaseName(job *Job) string {
+	sum := sha256.Sum256([]byte(strings.ToLower(job.Instance) + "/" +
+		job.Name))
+
+	return fmt.Sprintf("k8srun-%x", sum)[:47]
+}
+
+// holderIdentity identifies the run holding the lock, a restarted run
+// with the same run number takes its own lock over
+func holderIdentity(job *Job) string {
+	run := job.RunNumber
+
+	if run == "" {
+		run = string(uuid.NewUUID())
+	}
+
+	return fmt.Sprintf("%v/%v/%v", job.Instance, job.Name, run)
+}
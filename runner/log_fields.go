@@ -0,0 +1,23 @@
+package runner
+
+import (
+	"github.com/ayashkov/k8srun/service"
+	"github.com/sirupsen/logrus"
+)
+
+// logJob attaches the AutoSys context of the job to the log entries
+func logJob(job *Job) {
+	service.AddLogFields(logrus.Fields{
+		"instance": job.Instance,
+		"job":      job.Name,
+		"template": job.Template,
+	})
+}
+
+// logPod attaches the pod being followed to the log entries
+func logPod(namespace string, name string) {
+	service.AddLogFields(logrus.Fields{
+		"namespace": namespace,
+		"pod":       name,
+	})
+}
@@ -0,0 +1,140 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"sync"
+	"time"
+)
+
+const logReconnectDelay = time.Second
+
+const maxLogReconnects = 5
+
+// lineWriter prefixes every line written to it and writes complete lines
+// only, so output of several containers sharing dst does not interleave
+type lineWriter struct {
+	mutex  *sync.Mutex
+	dst    io.Writer
+	prefix string
+	buffer bytes.Buffer
+}
+
+func (writer *lineWriter) Write(p []byte) (int, error) {
+	writer.buffer.Write(p)
+
+	for {
+		i := bytes.IndexByte(writer.buffer.Bytes(), '\n')
+
+		if i < 0 {
+			return len(p), nil
+		}
+
+		if err := writer.writeLine(writer.buffer.Next(i + 1)); err != nil {
+			return len(p), err
+		}
+	}
+}
+
+func (writer *lineWriter) Flush() error {
+	if writer.buffer.Len() == 0 {
+		return nil
+	}
+
+	line := append(writer.buffer.Bytes(), '\n')
+
+	writer.buffer.Reset()
+
+	return writer.writeLine(line)
+}
+
+func (writer *lineWriter) writeLine(line []byte) error {
+	writer.mutex.Lock()
+	defer writer.mutex.Unlock()
+
+	_, err := writer.dst.Write(append([]byte(writer.prefix), line...))
+
+	return err
+}
+
+// logFollower copies log lines prefixed with kubelet timestamps to dst
+// without the timestamps, remembering the last one so an interrupted
+// stream can be resumed without duplicating lines
+type logFollower struct {
+	dst    io.Writer
+	lines  int
+	last   time.Time
+	atLast int
+	skip   int
+}
+
+func (follower *logFollower) resumable() bool {
+	return !follower.last.IsZero()
+}
+
+func (follower *logFollower) copy(log io.Reader) error {
+	reader := bufio.NewReader(log)
+
+	// a resumed stream starts at the second of the last line, skip what
+	// has been copied already
+	follower.skip = follower.atLast
+
+	for {
+		line, err := reader.ReadString('\n')
+
+		if line != "" {
+			if writeErr := follower.write(line); writeErr != nil {
+				return writeErr
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		}
+
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (follower *logFollower) write(line string) error {
+	text := line
+
+	if i := strings.IndexByte(line, ' '); i > 0 {
+		if timestamp, err := time.Parse(time.RFC3339Nano, line[:i]); err == nil {
+			text = line[i+1:]
+
+			switch {
+			case timestamp.Before(follower.last):
+				return nil
+			case timestamp.Equal(follower.last):
+				if follower.skip > 0 {
+					follower.skip--
+
+					return nil
+				}
+
+				follower.atLast++
+			default:
+				follower.last = timestamp
+				follower.atLast = 1
+				follower.skip = 0
+			}
+		}
+	}
+
+	follower.lines++
+
+	_, err := io.WriteString(follower.dst, text)
+
+	return err
+}
+
+func (follower *logFollower) flush() {
+	if writer, ok := follower.dst.(*lineWriter); ok {
+		writer.Flush()
+	}
+}
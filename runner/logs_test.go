@@ -0,0 +1,128 @@
+package runner_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/ayashkov/k8srun/runner"
+	"github.com/sirupsen/logrus"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedCore "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/rest"
+	fakeRest "k8s.io/client-go/rest/fake"
+)
+
+// logPods serves the given log stream bodies one after another and
+// records the options each stream was requested with
+type logPods struct {
+	typedCore.PodInterface
+
+	mutex   sync.Mutex
+	logs    []string
+	options []*core.PodLogOptions
+	opened  func(n int)
+}
+
+func (pods *logPods) GetLogs(name string,
+	options *core.PodLogOptions) *rest.Request {
+	pods.mutex.Lock()
+	defer pods.mutex.Unlock()
+
+	n := len(pods.options)
+	body := ""
+
+	if n < len(pods.logs) {
+		body = pods.logs[n]
+	}
+
+	pods.options = append(pods.options, options.DeepCopy())
+
+	if pods.opened != nil {
+		pods.opened(n)
+	}
+
+	client := &fakeRest.RESTClient{
+		Client: fakeRest.CreateHTTPClient(
+			func(*http.Request) (*http.Response, error) {
+				return &http.Response{
+					StatusCode: http.StatusOK,
+					Body:       io.NopCloser(strings.NewReader(body)),
+				}, nil
+			}),
+		NegotiatedSerializer: scheme.Codecs.WithoutConversion(),
+	}
+
+	return client.Request()
+}
+
+func Test_Execution_CopyLogs_ResumesStream_WhenStreamIsInterrupted(t *testing.T) {
+	assert := setUp(t)
+	pod := newPod("log-me", core.PodRunning)
+	clientset := fake.NewSimpleClientset(pod)
+	pods := &logPods{
+		PodInterface: clientset.CoreV1().Pods("namespace"),
+		logs: []string{
+			"2023-04-01T10:00:01.100Z one\n" +
+				"2023-04-01T10:00:02.200Z two\n",
+			"2023-04-01T10:00:01.100Z one\n" +
+				"2023-04-01T10:00:02.200Z two\n" +
+				"2023-04-01T10:00:02.200Z two again\n" +
+				"2023-04-01T10:00:03.300Z three\n",
+			"2023-04-01T10:00:03.300Z three\n" +
+				"2023-04-01T10:00:04.400Z four",
+		},
+	}
+	pods.opened = func(n int) {
+		if n == 1 {
+			go pods.UpdateStatus(ctx, terminatedPod("log-me", 0),
+				meta.UpdateOptions{})
+		}
+	}
+
+	execution := runner.Execution{Pod: pod, Pods: pods}
+	out := new(bytes.Buffer)
+
+	defer execution.Delete(ctx)
+
+	assert.Nil(execution.CopyLogs(ctx, out))
+	assert.Equal("one\ntwo\ntwo again\nthree\nfour", out.String())
+	assert.Equal(3, len(pods.options))
+	assert.True(pods.options[0].Follow)
+	assert.True(pods.options[0].Timestamps)
+	assert.Nil(pods.options[0].SinceTime)
+	assert.True(pods.options[1].Follow)
+	assert.Equal(time.Date(2023, 4, 1, 10, 0, 2, 200000000, time.UTC),
+		pods.options[1].SinceTime.Time.UTC())
+	assert.False(pods.options[2].Follow)
+	assert.Equal(time.Date(2023, 4, 1, 10, 0, 3, 300000000, time.UTC),
+		pods.options[2].SinceTime.Time.UTC())
+	assert.Empty(logger.Entries)
+}
+
+func Test_Execution_CopyLogs_WarnsAboutGap_WhenStreamCannotBeResumed(t *testing.T) {
+	assert := setUp(t)
+	pod := newPod("log-me", core.PodRunning)
+	pods := &logPods{
+		PodInterface: fake.NewSimpleClientset(pod).CoreV1().Pods("namespace"),
+		logs:         []string{"no timestamps\n"},
+	}
+	execution := runner.Execution{Pod: pod, Pods: pods}
+	out := new(bytes.Buffer)
+
+	defer execution.Delete(ctx)
+
+	assert.Nil(execution.CopyLogs(ctx, out))
+	assert.Equal("no timestamps\n", out.String())
+	assert.Equal(1, len(logger.Entries))
+	assert.Equal(logrus.WarnLevel, logger.LastEntry().Level)
+	assert.Equal("log of container \"job\" may be incomplete, its log stream "+
+		"ended without timestamps to resume from", logger.LastEntry().Message)
+}
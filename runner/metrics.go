@@ -0,0 +1,665 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ayashkov/k8srun/service"
+	"github.com/golang/protobuf/proto"
+	dto "github.com/prometheus/client_model/go"
+	"github.com/prometheus/common/expfmt"
+	core "k8s.io/api/core/v1"
+)
+
+const (
+	METRIC_RUNS         = "k8srun_runs_total"
+	METRIC_RUN_DURATION = "k8srun_run_duration_seconds"
+	METRIC_SCHEDULING   = "k8srun_pod_scheduling_seconds"
+	METRIC_IMAGE_PULL   = "k8srun_image_pull_seconds"
+	METRIC_API_ERRORS   = "k8srun_api_errors_total"
+	METRIC_LAST_RUN     = "k8srun_last_run_timestamp_seconds"
+	METRIC_LAST_EXIT    = "k8srun_last_run_exit_code"
+)
+
+// the gauges of a single run pushed to a Pushgateway
+const (
+	METRIC_LAST_OUTCOME    = "k8srun_last_run_outcome"
+	METRIC_LAST_DURATION   = "k8srun_last_run_duration_seconds"
+	METRIC_LAST_SCHEDULING = "k8srun_last_run_pod_scheduling_seconds"
+	METRIC_LAST_IMAGE_PULL = "k8srun_last_run_image_pull_seconds"
+	METRIC_LAST_API_ERRORS = "k8srun_last_run_api_errors"
+)
+
+const (
+	OUTCOME_SUCCEEDED = "succeeded"
+	OUTCOME_FAILED    = "failed"
+	OUTCOME_KILLED    = "killed"
+	OUTCOME_TIMEOUT   = "timeout"
+	OUTCOME_SKIPPED   = "skipped"
+	OUTCOME_ERROR     = "error"
+)
+
+const metricsPushTimeout = 10 * time.Second
+
+var metricBuckets = []float64{0.5, 1, 2.5, 5, 10, 30, 60, 300, 900, 1800,
+	3600, 7200, 14400}
+
+type metricFamily struct {
+	kind dto.MetricType
+	help string
+}
+
+var metricFamilies = map[string]metricFamily{
+	METRIC_RUNS: {dto.MetricType_COUNTER,
+		"Runs by template, AutoSys instance, job and outcome"},
+	METRIC_RUN_DURATION: {dto.MetricType_HISTOGRAM,
+		"Duration of the runs from the start of k8srun to its exit"},
+	METRIC_SCHEDULING: {dto.MetricType_HISTOGRAM,
+		"Time from the creation of the pod to its scheduling on a node"},
+	METRIC_IMAGE_PULL: {dto.MetricType_HISTOGRAM,
+		"Time spent pulling the images of the pod"},
+	METRIC_API_ERRORS: {dto.MetricType_COUNTER,
+		"Failed Kubernetes API requests by HTTP method and status code"},
+	METRIC_LAST_RUN: {dto.MetricType_GAUGE,
+		"Time of the end of the last run"},
+	METRIC_LAST_EXIT: {dto.MetricType_GAUGE,
+		"Exit code of the last run"},
+	METRIC_LAST_OUTCOME: {dto.MetricType_GAUGE,
+		"Outcome of the last run, always 1"},
+	METRIC_LAST_DURATION: {dto.MetricType_GAUGE,
+		"Duration of the last run"},
+	METRIC_LAST_SCHEDULING: {dto.MetricType_GAUGE,
+		"Time the pod of the last run waited to be scheduled"},
+	METRIC_LAST_IMAGE_PULL: {dto.MetricType_GAUGE,
+		"Time the pod of the last run spent pulling its images"},
+	METRIC_LAST_API_ERRORS: {dto.MetricType_GAUGE,
+		"Failed Kubernetes API requests of the last run"},
+}
+
+// lastRunMetrics maps the histograms to the gauges of a single run
+var lastRunMetrics = map[string]string{
+	METRIC_SCHEDULING: METRIC_LAST_SCHEDULING,
+	METRIC_IMAGE_PULL: METRIC_LAST_IMAGE_PULL,
+}
+
+// metrics holds the families recorded during a run, keyed by their name
+type metrics struct {
+	mutex    sync.Mutex
+	families map[string]*dto.MetricFamily
+}
+
+func newMetrics() *metrics {
+	return &metrics{families: map[string]*dto.MetricFamily{}}
+}
+
+// metric returns the series of the family with the labels, adding it when
+// it is new
+func (metrics *metrics) metric(name string,
+	labels []*dto.LabelPair) *dto.Metric {
+	family, ok := metrics.families[name]
+
+	if !ok {
+		family = &dto.MetricFamily{
+			Name: proto.String(name),
+			Help: proto.String(metricFamilies[name].help),
+			Type: metricFamilies[name].kind.Enum(),
+		}
+		metrics.families[name] = family
+	}
+
+	for _, metric := range family.Metric {
+		if sameLabels(metric.Label, labels) {
+			return metric
+		}
+	}
+
+	metric := &dto.Metric{Label: labels}
+
+	switch family.GetType() {
+	case dto.MetricType_COUNTER:
+		metric.Counter = &dto.Counter{Value: proto.Float64(0)}
+	case dto.MetricType_GAUGE:
+		metric.Gauge = &dto.Gauge{Value: proto.Float64(0)}
+	case dto.MetricType_HISTOGRAM:
+		metric.Histogram = &dto.Histogram{
+			SampleCount: proto.Uint64(0),
+			SampleSum:   proto.Float64(0),
+		}
+
+		for _, le := range metricBuckets {
+			metric.Histogram.Bucket = append(metric.Histogram.Bucket,
+				&dto.Bucket{
+					UpperBound:      proto.Float64(le),
+					CumulativeCount: proto.Uint64(0),
+				})
+		}
+	}
+
+	family.Metric = append(family.Metric, metric)
+
+	return metric
+}
+
+func (metrics *metrics) inc(name string, labels map[string]string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	counter := metrics.metric(name, labelPairs(labels)).Counter
+
+	counter.Value = proto.Float64(counter.GetValue() + 1)
+}
+
+func (metrics *metrics) set(name string, labels map[string]string,
+	value float64) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	metrics.metric(name, labelPairs(labels)).Gauge.Value = proto.Float64(value)
+}
+
+func (metrics *metrics) observe(name string, labels map[string]string,
+	value float64) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	histogram := metrics.metric(name, labelPairs(labels)).Histogram
+
+	histogram.SampleCount = proto.Uint64(histogram.GetSampleCount() + 1)
+	histogram.SampleSum = proto.Float64(histogram.GetSampleSum() + value)
+
+	for _, bucket := range histogram.Bucket {
+		if value <= bucket.GetUpperBound() {
+			bucket.CumulativeCount = proto.Uint64(
+				bucket.GetCumulativeCount() + 1)
+		}
+	}
+}
+
+// relabel adds the labels to every series of the family
+func (metrics *metrics) relabel(name string, labels map[string]string) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	family, ok := metrics.families[name]
+
+	if !ok {
+		return
+	}
+
+	for _, metric := range family.Metric {
+		merged := labels
+
+		for _, pair := range metric.Label {
+			merged = withLabel(merged, pair.GetName(), pair.GetValue())
+		}
+
+		metric.Label = labelPairs(merged)
+	}
+}
+
+// total sums the series of the counter family
+func (metrics *metrics) total(name string) float64 {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	total := 0.0
+
+	if family, ok := metrics.families[name]; ok {
+		for _, metric := range family.Metric {
+			total += metric.GetCounter().GetValue()
+		}
+	}
+
+	return total
+}
+
+// WriteTo writes the metrics in the Prometheus text exposition format
+func (metrics *metrics) WriteTo(w io.Writer) (int64, error) {
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	names := make([]string, 0, len(metrics.families))
+
+	for name := range metrics.families {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	var written int64
+
+	for _, name := range names {
+		n, err := expfmt.MetricFamilyToText(w, metrics.families[name])
+		written += int64(n)
+
+		if err != nil {
+			return written, err
+		}
+	}
+
+	return written, nil
+}
+
+// merge adds the counters and histograms of a previously written textfile
+// to the metrics, so they keep counting across the runs of the job
+func (metrics *metrics) merge(r io.Reader) error {
+	var parser expfmt.TextParser
+
+	families, err := parser.TextToMetricFamilies(r)
+
+	if err != nil {
+		return err
+	}
+
+	metrics.mutex.Lock()
+	defer metrics.mutex.Unlock()
+
+	for name, family := range families {
+		if family.GetType() != metricFamilies[name].kind {
+			continue
+		}
+
+		for _, previous := range family.Metric {
+			// the series without the labels of the run, written by older
+			// versions, would clash with the files of the other jobs
+			if !hasLabel(previous.Label, "autosys_job") {
+				continue
+			}
+
+			switch family.GetType() {
+			case dto.MetricType_COUNTER:
+				counter := metrics.metric(name, previous.Label).Counter
+
+				counter.Value = proto.Float64(counter.GetValue() +
+					previous.GetCounter().GetValue())
+			case dto.MetricType_HISTOGRAM:
+				mergeHistogram(metrics.metric(name, previous.Label).Histogram,
+					previous.GetHistogram())
+			}
+		}
+	}
+
+	return nil
+}
+
+func mergeHistogram(histogram *dto.Histogram, previous *dto.Histogram) {
+	histogram.SampleCount = proto.Uint64(histogram.GetSampleCount() +
+		previous.GetSampleCount())
+	histogram.SampleSum = proto.Float64(histogram.GetSampleSum() +
+		previous.GetSampleSum())
+
+	for _, bucket := range histogram.Bucket {
+		for _, old := range previous.Bucket {
+			if old.GetUpperBound() == bucket.GetUpperBound() {
+				bucket.CumulativeCount = proto.Uint64(
+					bucket.GetCumulativeCount() + old.GetCumulativeCount())
+			}
+		}
+	}
+}
+
+// writeTextfile writes the metrics of the job to the textfile collector
+// directory of the node exporter, replacing the file atomically
+func (metrics *metrics) writeTextfile(dir string, job *Job) error {
+	path := filepath.Join(dir, "k8srun-"+labelValue(job.Instance)+"-"+
+		labelValue(job.Name)+".prom")
+
+	if previous, err := os.Open(path); err == nil {
+		err = metrics.merge(previous)
+		previous.Close()
+
+		if err != nil {
+			service.Log.Warnf("error reading previous metrics %q, "+
+				"starting over: %v", path, err)
+		}
+	}
+
+	file, err := os.CreateTemp(dir, ".k8srun-*")
+
+	if err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+
+	defer os.Remove(file.Name())
+
+	if _, err := metrics.WriteTo(file); err != nil {
+		file.Close()
+
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+
+	// the textfile collector needs to be able to read the file
+	if err := os.Chmod(file.Name(), 0644); err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+
+	if err := os.Rename(file.Name(), path); err != nil {
+		return fmt.Errorf("error writing metrics: %w", err)
+	}
+
+	return nil
+}
+
+// push posts the metrics to a Pushgateway compatible endpoint
+func (metrics *metrics) push(url string) error {
+	var body bytes.Buffer
+
+	metrics.WriteTo(&body)
+
+	ctx, cancel := context.WithTimeout(context.Background(),
+		metricsPushTimeout)
+
+	defer cancel()
+
+	request, err := http.NewRequestWithContext(ctx, http.MethodPost, url,
+		&body)
+
+	if err != nil {
+		return fmt.Errorf("error pushing metrics: %w", err)
+	}
+
+	request.Header.Set("Content-Type", string(expfmt.FmtText))
+
+	response, err := http.DefaultClient.Do(request)
+
+	if err != nil {
+		return fmt.Errorf("error pushing metrics: %w", err)
+	}
+
+	defer response.Body.Close()
+
+	if response.StatusCode/100 != 2 {
+		return fmt.Errorf("error pushing metrics to %v: %v", url,
+			response.Status)
+	}
+
+	return nil
+}
+
+// groupingURL appends the labels of the run to the grouping key of the
+// Pushgateway URL, so the runs of different jobs do not replace each other
+func groupingURL(url string, labels map[string]string) string {
+	names := make([]string, 0, len(labels))
+
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	url = strings.TrimRight(url, "/")
+
+	for _, name := range names {
+		value := base64.URLEncoding.EncodeToString([]byte(labels[name]))
+
+		if value == "" {
+			value = "="
+		}
+
+		url += "/" + name + "@base64/" + value
+	}
+
+	return url
+}
+
+// recordRun records the outcome of the run and the latencies of its pod,
+// then writes them to the textfile or pushes them as configured by the job
+func (runner *defaultRunner) recordRun(job *Job, execution *Execution,
+	started time.Time, exitCode int, err error) {
+	metrics := runner.metrics
+	labels := map[string]string{
+		"autosys_instance": job.Instance,
+		"autosys_job":      job.Name,
+		"template":         job.Template,
+	}
+
+	if err != nil {
+		exitCode = ExitCode(err)
+	}
+
+	duration := time.Since(started).Seconds()
+	latencies := map[string]float64{}
+
+	if execution != nil {
+		latencies = execution.latencies()
+	}
+
+	// a pushed run replaces the previous one of its group, so it is pushed
+	// as gauges of its own instead of counters that would never accumulate
+	if job.MetricsURL != "" {
+		pushed := newMetrics()
+
+		pushed.set(METRIC_LAST_OUTCOME, map[string]string{
+			"outcome": outcome(exitCode, err),
+		}, 1)
+		pushed.set(METRIC_LAST_RUN, nil, float64(time.Now().Unix()))
+		pushed.set(METRIC_LAST_EXIT, nil, float64(exitCode))
+		pushed.set(METRIC_LAST_DURATION, nil, duration)
+		pushed.set(METRIC_LAST_API_ERRORS, nil,
+			metrics.total(METRIC_API_ERRORS))
+
+		for family, value := range latencies {
+			pushed.set(lastRunMetrics[family], nil, value)
+		}
+
+		if err := pushed.push(groupingURL(job.MetricsURL,
+			labels)); err != nil {
+			service.Log.Warn(err)
+		}
+	}
+
+	if job.MetricsDir != "" {
+		// the files of the jobs on a node must not share any series
+		metrics.relabel(METRIC_API_ERRORS, labels)
+		metrics.inc(METRIC_RUNS, withLabel(labels, "outcome",
+			outcome(exitCode, err)))
+		metrics.observe(METRIC_RUN_DURATION, labels, duration)
+		metrics.set(METRIC_LAST_RUN, labels, float64(time.Now().Unix()))
+		metrics.set(METRIC_LAST_EXIT, labels, float64(exitCode))
+
+		for family, value := range latencies {
+			metrics.observe(family, labels, value)
+		}
+
+		if err := metrics.writeTextfile(job.MetricsDir, job); err != nil {
+			service.Log.Warn(err)
+		}
+	}
+}
+
+// latencies tells how long the pod waited to be scheduled and to pull its
+// images, the latter from the Pulling and Pulled events
+func (execution *Execution) latencies() map[string]float64 {
+	latencies := map[string]float64{}
+	pod := execution.lastPod()
+
+	if pod == nil || pod.Name == "" {
+		return latencies
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == core.PodScheduled &&
+			condition.Status == core.ConditionTrue &&
+			!pod.CreationTimestamp.IsZero() {
+			latencies[METRIC_SCHEDULING] = condition.LastTransitionTime.Sub(
+				pod.CreationTimestamp.Time).Seconds()
+		}
+	}
+
+	if execution.Events == nil {
+		return latencies
+	}
+
+	events, err := execution.Events.List(context.Background(),
+		eventOptions(pod))
+
+	if err != nil {
+		service.Log.Debugf("error listing events of pod %q: %v", pod.Name, err)
+
+		return latencies
+	}
+
+	var pulling, pulled time.Time
+
+	for _, event := range events.Items {
+		switch event.Reason {
+		case "Pulling":
+			if pulling.IsZero() || eventTime(&event).Before(pulling) {
+				pulling = eventTime(&event)
+			}
+		case "Pulled":
+			if eventTime(&event).After(pulled) {
+				pulled = eventTime(&event)
+			}
+		}
+	}
+
+	if !pulling.IsZero() && !pulled.Before(pulling) {
+		latencies[METRIC_IMAGE_PULL] = pulled.Sub(pulling).Seconds()
+	}
+
+	return latencies
+}
+
+func eventTime(event *core.Event) time.Time {
+	if !event.LastTimestamp.IsZero() {
+		return event.LastTimestamp.Time
+	}
+
+	if !event.EventTime.IsZero() {
+		return event.EventTime.Time
+	}
+
+	return event.FirstTimestamp.Time
+}
+
+// apiErrors counts the failed requests to the Kubernetes API
+type apiErrors struct {
+	metrics *metrics
+	next    http.RoundTripper
+}
+
+func (transport *apiErrors) RoundTrip(request *http.Request) (*http.Response,
+	error) {
+	response, err := transport.next.RoundTrip(request)
+	code := ""
+
+	switch {
+	case err != nil:
+		code = "error"
+	case response.StatusCode >= 500 ||
+		response.StatusCode == http.StatusTooManyRequests ||
+		response.StatusCode == http.StatusUnauthorized ||
+		response.StatusCode == http.StatusForbidden:
+		code = strconv.Itoa(response.StatusCode)
+	}
+
+	if code != "" {
+		transport.metrics.inc(METRIC_API_ERRORS, map[string]string{
+			"method": request.Method,
+			"code":   code,
+		})
+	}
+
+	return response, err
+}
+
+func outcome(exitCode int, err error) string {
+	if err == nil {
+		if exitCode == 0 {
+			return OUTCOME_SUCCEEDED
+		}
+
+		return OUTCOME_FAILED
+	}
+
+	switch exitCode {
+	case EXIT_KILLED:
+		return OUTCOME_KILLED
+	case EXIT_START_TIMEOUT, EXIT_RUN_TIMEOUT, EXIT_COMPLETION_TIMEOUT,
+		EXIT_QUEUE_TIMEOUT:
+		return OUTCOME_TIMEOUT
+	case EXIT_SKIPPED:
+		return OUTCOME_SKIPPED
+	}
+
+	return OUTCOME_ERROR
+}
+
+func withLabel(labels map[string]string, name string,
+	value string) map[string]string {
+	result := map[string]string{name: value}
+
+	for label, value := range labels {
+		result[label] = value
+	}
+
+	return result
+}
+
+// labelPairs returns the labels sorted by name
+func labelPairs(labels map[string]string) []*dto.LabelPair {
+	names := make([]string, 0, len(labels))
+
+	for name := range labels {
+		names = append(names, name)
+	}
+
+	sort.Strings(names)
+
+	pairs := make([]*dto.LabelPair, len(names))
+
+	for i, name := range names {
+		pairs[i] = &dto.LabelPair{
+			Name:  proto.String(name),
+			Value: proto.String(labels[name]),
+		}
+	}
+
+	return pairs
+}
+
+func hasLabel(pairs []*dto.LabelPair, name string) bool {
+	for _, pair := range pairs {
+		if pair.GetName() == name {
+			return true
+		}
+	}
+
+	return false
+}
+
+func sameLabels(a []*dto.LabelPair, b []*dto.LabelPair) bool {
+	if len(a) != len(b) {
+		return false
+	}
+
+	values := map[string]string{}
+
+	for _, pair := range a {
+		values[pair.GetName()] = pair.GetValue()
+	}
+
+	for _, pair := range b {
+		if value, ok := values[pair.GetName()]; !ok || value != pair.GetValue() {
+			return false
+		}
+	}
+
+	return true
+}
@@ -0,0 +1,165 @@
+package runner_test
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/ayashkov/k8srun/runner"
+	"github.com/golang/mock/gomock"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
+)
+
+func Test_Runner_Run_AccumulatesTextfileMetrics_WhenMetricsDirIsGiven(t *testing.T) {
+	assert := setUp(t)
+	scheduled := meta.NewTime(time.Now())
+	started := meta.NewTime(scheduled.Add(time.Second))
+	finished := meta.NewTime(scheduled.Add(time.Minute))
+	job := newJob()
+
+	job.MetricsDir = t.TempDir()
+
+	for i := 0; i < 2; i++ {
+		jobRunner, clientset := newRunner(t, newTemplate("template"))
+
+		completePods(clientset, 3, scheduled, started, finished)
+
+		exitCode, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+		assert.Nil(err)
+		assert.Equal(3, exitCode)
+	}
+
+	data, err := os.ReadFile(filepath.Join(job.MetricsDir,
+		"k8srun-ace-test_job.prom"))
+
+	assert.Nil(err)
+
+	labels := `autosys_instance="ACE",autosys_job="TEST_JOB",`
+
+	assert.Contains(string(data), "# TYPE k8srun_runs_total counter\n")
+	assert.Contains(string(data), "k8srun_runs_total{"+labels+
+		`outcome="failed",template="template"} 2`+"\n")
+	assert.Contains(string(data), "k8srun_run_duration_seconds_count{"+
+		labels+`template="template"} 2`+"\n")
+	assert.Contains(string(data), "k8srun_last_run_exit_code{"+labels+
+		`template="template"} 3`+"\n")
+	assert.Contains(string(data), "k8srun_pod_scheduling_seconds_bucket{"+
+		labels+`template="template",le="0.5"} 0`+"\n")
+	assert.Contains(string(data), "k8srun_pod_scheduling_seconds_bucket{"+
+		labels+`template="template",le="1"} 2`+"\n")
+}
+
+func Test_Runner_Run_LabelsTextfileAPIErrors_WithRun(t *testing.T) {
+	assert := setUp(t)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+
+	defer server.Close()
+
+	mockClient.EXPECT().
+		NewClientConfig(gomock.Any(), gomock.Any()).
+		Return(clientConfig)
+	clientConfig.EXPECT().
+		Namespace().
+		Return("namespace", false, nil)
+	clientConfig.EXPECT().
+		ClientConfig().
+		Return(&rest.Config{Host: server.URL}, nil)
+	mockClient.EXPECT().
+		NewClientset(gomock.Any()).
+		DoAndReturn(func(config *rest.Config) (kubernetes.Interface, error) {
+			return kubernetes.NewForConfig(config)
+		})
+
+	jobRunner, err := factory.New("")
+
+	assert.Nil(err)
+
+	job := newJob()
+
+	job.MetricsDir = t.TempDir()
+
+	_, err = jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(runner.EXIT_ERROR, runner.ExitCode(err))
+
+	data, err := os.ReadFile(filepath.Join(job.MetricsDir,
+		"k8srun-ace-test_job.prom"))
+
+	assert.Nil(err)
+	assert.Contains(string(data), `k8srun_api_errors_total{`+
+		`autosys_instance="ACE",autosys_job="TEST_JOB",code="500",`+
+		`method="GET",template="template"}`)
+}
+
+func Test_Runner_Run_PushesMetrics_WhenMetricsURLIsGiven(t *testing.T) {
+	assert := setUp(t)
+	pushed := make(chan string, 1)
+	server := httptest.NewServer(http.HandlerFunc(
+		func(w http.ResponseWriter, r *http.Request) {
+			if r.URL.Path == "/metrics/job/k8srun"+
+				"/autosys_instance@base64/QUNF"+
+				"/autosys_job@base64/VEVTVF9KT0I="+
+				"/template@base64/dGVtcGxhdGU=" {
+				body, _ := io.ReadAll(r.Body)
+
+				assert.Equal(http.MethodPost, r.Method)
+				assert.Equal("text/plain; version=0.0.4; charset=utf-8",
+					r.Header.Get("Content-Type"))
+				pushed <- string(body)
+
+				return
+			}
+
+			w.WriteHeader(http.StatusInternalServerError)
+		}))
+
+	defer server.Close()
+
+	mockClient.EXPECT().
+		NewClientConfig(gomock.Any(), gomock.Any()).
+		Return(clientConfig)
+	clientConfig.EXPECT().
+		Namespace().
+		Return("namespace", false, nil)
+	clientConfig.EXPECT().
+		ClientConfig().
+		Return(&rest.Config{Host: server.URL}, nil)
+	mockClient.EXPECT().
+		NewClientset(gomock.Any()).
+		DoAndReturn(func(config *rest.Config) (kubernetes.Interface, error) {
+			return kubernetes.NewForConfig(config)
+		})
+
+	jobRunner, err := factory.New("")
+
+	assert.Nil(err)
+
+	job := newJob()
+
+	job.MetricsURL = server.URL + "/metrics/job/k8srun"
+
+	_, err = jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(runner.EXIT_ERROR, runner.ExitCode(err))
+
+	body := <-pushed
+
+	assert.Contains(body, "# TYPE k8srun_last_run_outcome gauge\n")
+	assert.Contains(body, `k8srun_last_run_outcome{outcome="error"} 1`)
+	assert.Contains(body, "k8srun_last_run_exit_code "+
+		strconv.Itoa(runner.EXIT_ERROR)+"\n")
+	assert.NotContains(body, "k8srun_last_run_api_errors 0\n")
+	assert.NotContains(body, "_total")
+}
@@ -0,0 +1,269 @@
+package runner
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"os"
+	"strings"
+
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+)
+
+// OVERRIDES is the template annotation listing the command line overrides
+// allowed for the template, comma-separated, or * for all of them
+const OVERRIDES = "k8srun.yashkov.org/overrides"
+
+const (
+	OVERRIDE_IMAGE           = "image"
+	OVERRIDE_ENV             = "env"
+	OVERRIDE_RESOURCES       = "resources"
+	OVERRIDE_NODE_SELECTOR   = "node-selector"
+	OVERRIDE_TOLERATIONS     = "tolerations"
+	OVERRIDE_SERVICE_ACCOUNT = "service-account"
+	OVERRIDE_PATCH           = "patch"
+)
+
+// Overrides are the changes to the pod of the template requested on the
+// command line
+type Overrides struct {
+	Image          string
+	Env            []string
+	EnvFile        string
+	CPU            string
+	Memory         string
+	CPULimit       string
+	MemoryLimit    string
+	NodeSelector   map[string]string
+	Tolerations    []string
+	ServiceAccount string
+}
+
+// requestedOverrides returns the overrides the job uses
+func requestedOverrides(job *Job) []string {
+	overrides := &job.Overrides
+	requested := []string{}
+
+	if overrides.Image != "" {
+		requested = append(requested, OVERRIDE_IMAGE)
+	}
+
+	if len(overrides.Env) > 0 || overrides.EnvFile != "" {
+		requested = append(requested, OVERRIDE_ENV)
+	}
+
+	if overrides.CPU != "" || overrides.Memory != "" ||
+		overrides.CPULimit != "" || overrides.MemoryLimit != "" {
+		requested = append(requested, OVERRIDE_RESOURCES)
+	}
+
+	if len(overrides.NodeSelector) > 0 {
+		requested = append(requested, OVERRIDE_NODE_SELECTOR)
+	}
+
+	if len(overrides.Tolerations) > 0 {
+		requested = append(requested, OVERRIDE_TOLERATIONS)
+	}
+
+	if overrides.ServiceAccount != "" {
+		requested = append(requested, OVERRIDE_SERVICE_ACCOUNT)
+	}
+
+	if len(job.PatchFiles) > 0 {
+		requested = append(requested, OVERRIDE_PATCH)
+	}
+
+	return requested
+}
+
+// checkOverrides makes sure the template allows every override of the job,
+// and its policy every variable the overrides set
+func checkOverrides(template *Template, job *Job) error {
+	allowed := rules(template.Annotations[OVERRIDES])
+
+	for _, name := range requestedOverrides(job) {
+		if !contains(allowed, "*") && !containsFold(allowed, name) {
+			return fmt.Errorf("override %v is not allowed by template %q, "+
+				"template annotation %v allows %q", name, template.Name,
+				OVERRIDES, allowed)
+		}
+	}
+
+	if template.Policy == nil || template.Policy.Env == nil {
+		return nil
+	}
+
+	env, err := job.Overrides.env()
+
+	if err != nil {
+		return err
+	}
+
+	for name := range env {
+		if !containsFold(template.Policy.Env, name) {
+			return fmt.Errorf("variable %v is not allowed by template %q",
+				name, template.Name)
+		}
+	}
+
+	return nil
+}
+
+// applyOverrides applies the overrides of the job to the main container and
+// the pod
+func applyOverrides(pod *core.Pod, main int, job *Job) error {
+	overrides := &job.Overrides
+	container := &pod.Spec.Containers[main]
+
+	if overrides.Image != "" {
+		container.Image = overrides.Image
+	}
+
+	env, err := overrides.env()
+
+	if err != nil {
+		return err
+	}
+
+	setEnv(container, env)
+
+	if err := setQuantity(&container.Resources.Requests, core.ResourceCPU,
+		overrides.CPU, "cpu request"); err != nil {
+		return err
+	}
+
+	if err := setQuantity(&container.Resources.Requests,
+		core.ResourceMemory, overrides.Memory, "memory request"); err != nil {
+		return err
+	}
+
+	if err := setQuantity(&container.Resources.Limits, core.ResourceCPU,
+		overrides.CPULimit, "cpu limit"); err != nil {
+		return err
+	}
+
+	if err := setQuantity(&container.Resources.Limits, core.ResourceMemory,
+		overrides.MemoryLimit, "memory limit"); err != nil {
+		return err
+	}
+
+	for key, value := range overrides.NodeSelector {
+		if pod.Spec.NodeSelector == nil {
+			pod.Spec.NodeSelector = map[string]string{}
+		}
+
+		pod.Spec.NodeSelector[key] = value
+	}
+
+	for _, text := range overrides.Tolerations {
+		toleration, err := parseToleration(text)
+
+		if err != nil {
+			return err
+		}
+
+		pod.Spec.Tolerations = append(pod.Spec.Tolerations, toleration)
+	}
+
+	if overrides.ServiceAccount != "" {
+		pod.Spec.ServiceAccountName = overrides.ServiceAccount
+	}
+
+	return nil
+}
+
+// env returns the variables of the env file overridden by the --env ones
+func (overrides *Overrides) env() (map[string]string, error) {
+	env := map[string]string{}
+
+	if overrides.EnvFile != "" {
+		content, err := os.ReadFile(overrides.EnvFile)
+
+		if err != nil {
+			return nil, err
+		}
+
+		scanner := bufio.NewScanner(bytes.NewReader(content))
+
+		for line := 1; scanner.Scan(); line++ {
+			text := strings.TrimSpace(scanner.Text())
+
+			if text == "" || strings.HasPrefix(text, "#") {
+				continue
+			}
+
+			name, value, ok := strings.Cut(text, "=")
+
+			if !ok || strings.TrimSpace(name) == "" {
+				return nil, fmt.Errorf("invalid variable at %v:%v, "+
+					"expected NAME=VALUE", overrides.EnvFile, line)
+			}
+
+			env[strings.TrimSpace(name)] = value
+		}
+	}
+
+	for _, text := range overrides.Env {
+		name, value, ok := strings.Cut(text, "=")
+
+		if !ok || name == "" {
+			return nil, fmt.Errorf("invalid variable %q, expected NAME=VALUE",
+				text)
+		}
+
+		env[name] = value
+	}
+
+	return env, nil
+}
+
+func setQuantity(list *core.ResourceList, name core.ResourceName,
+	text string, description string) error {
+	if text == "" {
+		return nil
+	}
+
+	quantity, err := resource.ParseQuantity(text)
+
+	if err != nil {
+		return fmt.Errorf("invalid %v %q: %w", description, text, err)
+	}
+
+	if *list == nil {
+		*list = core.ResourceList{}
+	}
+
+	(*list)[name] = quantity
+
+	return nil
+}
+
+// parseToleration parses a toleration in the taint syntax of kubectl,
+// key[=value]:effect, where an empty effect tolerates every effect
+func parseToleration(text string) (core.Toleration, error) {
+	spec, effect, _ := strings.Cut(text, ":")
+	key, value, hasValue := strings.Cut(spec, "=")
+	toleration := core.Toleration{
+		Key:      key,
+		Operator: core.TolerationOpExists,
+		Effect:   core.TaintEffect(effect),
+	}
+
+	if hasValue {
+		toleration.Operator = core.TolerationOpEqual
+		toleration.Value = value
+	}
+
+	switch toleration.Effect {
+	case "", core.TaintEffectNoSchedule, core.TaintEffectPreferNoSchedule,
+		core.TaintEffectNoExecute:
+		if key != "" {
+			return toleration, nil
+		}
+	}
+
+	return toleration, fmt.Errorf("invalid toleration %q, expected "+
+		"key[=value]:effect with effect NoSchedule, PreferNoSchedule or "+
+		"NoExecute", text)
+}
@@ -0,0 +1,219 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+
+	jsonpatch "github.com/evanphx/json-patch"
+	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/util/strategicpatch"
+	"sigs.k8s.io/yaml"
+)
+
+// BASE is the template annotation naming the template to inherit from
+const BASE = "k8srun.yashkov.org/base"
+
+const (
+	PATCH_STRATEGIC = "strategic"
+	PATCH_MERGE     = "merge"
+	PATCH_JSON      = "json"
+)
+
+const maxBaseDepth = 10
+
+// inherit returns the template with its pod template merged onto the ones
+// of its base templates, the most distant base first
+func inherit(ctx context.Context, source TemplateSource, namespace string,
+	template *Template) (*Template, error) {
+	chain := []*Template{template}
+	seen := map[string]bool{template.Name: true}
+
+	for base := template.Annotations[BASE]; base != ""; {
+		if seen[base] {
+			return nil, fmt.Errorf("template %q inherits from itself "+
+				"through base template %q", template.Name, base)
+		}
+
+		if len(chain) > maxBaseDepth {
+			return nil, fmt.Errorf("template %q has more than %v levels of "+
+				"base templates", template.Name, maxBaseDepth)
+		}
+
+		parent, err := source.Get(ctx, namespace, base)
+
+		if err != nil {
+			return nil, fmt.Errorf("error reading base template %q of %q: %w",
+				base, chain[len(chain)-1].Name, err)
+		}
+
+		chain = append(chain, parent)
+		seen[base] = true
+		base = parent.Annotations[BASE]
+	}
+
+	if len(chain) == 1 {
+		return template, nil
+	}
+
+	merged := chain[len(chain)-1].Template
+
+	for i := len(chain) - 2; i >= 0; i-- {
+		var err error
+
+		merged, err = mergeTemplateSpec(merged, chain[i].Template)
+
+		if err != nil {
+			return nil, fmt.Errorf("error merging template %q onto its base: %w",
+				chain[i].Name, err)
+		}
+	}
+
+	result := &Template{
+		PodTemplate: template.PodTemplate.DeepCopy(),
+		Policy:      template.Policy,
+	}
+
+	result.Template = merged
+
+	return result, nil
+}
+
+// mergeTemplateSpec merges overlay onto base the way kubectl apply would,
+// fields missing from overlay are kept from base
+func mergeTemplateSpec(base core.PodTemplateSpec,
+	overlay core.PodTemplateSpec) (core.PodTemplateSpec, error) {
+	merged := core.PodTemplateSpec{}
+	original, err := json.Marshal(base)
+
+	if err != nil {
+		return merged, err
+	}
+
+	patch, err := json.Marshal(overlay)
+
+	if err != nil {
+		return merged, err
+	}
+
+	// an empty field of the overlay must not delete it from the base
+	patch, err = withoutNulls(patch)
+
+	if err != nil {
+		return merged, err
+	}
+
+	result, err := strategicpatch.StrategicMergePatch(original, patch,
+		core.PodTemplateSpec{})
+
+	if err != nil {
+		return merged, err
+	}
+
+	err = json.Unmarshal(result, &merged)
+
+	return merged, err
+}
+
+func withoutNulls(data []byte) ([]byte, error) {
+	var value any
+
+	if err := json.Unmarshal(data, &value); err != nil {
+		return nil, err
+	}
+
+	return json.Marshal(dropNulls(value))
+}
+
+func dropNulls(value any) any {
+	switch value := value.(type) {
+	case map[string]any:
+		for key, field := range value {
+			if field == nil {
+				delete(value, key)
+			} else {
+				value[key] = dropNulls(field)
+			}
+		}
+	case []any:
+		for i := range value {
+			value[i] = dropNulls(value[i])
+		}
+	}
+
+	return value
+}
+
+// applyPatches applies the patch files of the job to the pod in order, as
+// strategic merge, JSON merge or JSON patches
+func applyPatches(pod *core.Pod, job *Job) error {
+	if len(job.PatchFiles) == 0 {
+		return nil
+	}
+
+	document, err := json.Marshal(pod)
+
+	if err != nil {
+		return err
+	}
+
+	for _, file := range job.PatchFiles {
+		content, err := os.ReadFile(file)
+
+		if err != nil {
+			return err
+		}
+
+		patch, err := yaml.YAMLToJSON(content)
+
+		if err != nil {
+			return fmt.Errorf("invalid patch %v: %w", file, err)
+		}
+
+		patchType := job.PatchType
+
+		if patchType == "" {
+			patchType = PATCH_STRATEGIC
+
+			if strings.HasPrefix(strings.TrimSpace(string(patch)), "[") {
+				patchType = PATCH_JSON
+			}
+		}
+
+		switch patchType {
+		case PATCH_STRATEGIC:
+			document, err = strategicpatch.StrategicMergePatch(document, patch,
+				core.Pod{})
+		case PATCH_MERGE:
+			document, err = jsonpatch.MergePatch(document, patch)
+		case PATCH_JSON:
+			var decoded jsonpatch.Patch
+
+			decoded, err = jsonpatch.DecodePatch(patch)
+
+			if err == nil {
+				document, err = decoded.Apply(document)
+			}
+		default:
+			return fmt.Errorf("unsupported patch type %q, expected %q, %q "+
+				"or %q", patchType, PATCH_STRATEGIC, PATCH_MERGE, PATCH_JSON)
+		}
+
+		if err != nil {
+			return fmt.Errorf("error applying %v patch %v: %w", patchType,
+				file, err)
+		}
+	}
+
+	patched := core.Pod{}
+
+	if err := json.Unmarshal(document, &patched); err != nil {
+		return fmt.Errorf("invalid patched pod: %w", err)
+	}
+
+	*pod = patched
+
+	return nil
+}
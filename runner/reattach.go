@@ -0,0 +1,108 @@
+package runner
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"strings"
+
+	"github.com/ayashkov/k8srun/service"
+	batch "k8s.io/api/batch/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/runtime"
+)
+
+const RUN_KEY = "k8srun.yashkov.org/run-key"
+
+// runKey identifies a run of the job by its instance, name and run number,
+// it is empty when the run number is unknown
+func runKey(job *Job) string {
+	if job.RunNumber == "" {
+		return ""
+	}
+
+	sum := sha256.Sum256([]byte(strings.ToLower(job.Instance) + "/" +
+		job.Name + "/" + job.RunNumber))
+
+	return fmt.Sprintf("%x", sum)[:40]
+}
+
+// reattach points the execution to a still running pod or Job of the same
+// run, if there is one, and reports whether it has found it
+func (execution *Execution) reattach(ctx context.Context) (bool, error) {
+	key := runKey(execution.job())
+
+	if key == "" {
+		return false, nil
+	}
+
+	options := meta.ListOptions{
+		LabelSelector: labels.Set{RUN_KEY: key}.String(),
+	}
+
+	if execution.BatchJob != nil {
+		list, err := execution.Jobs.List(ctx, options)
+
+		if err != nil {
+			return false, err
+		}
+
+		var running *batch.Job
+
+		for i := range list.Items {
+			batchJob := &list.Items[i]
+
+			if batchJob.DeletionTimestamp != nil ||
+				jobCondition(batchJob) != nil {
+				continue
+			}
+
+			if running == nil || running.CreationTimestamp.Before(
+				&batchJob.CreationTimestamp) {
+				running = batchJob
+			}
+		}
+
+		if running == nil {
+			return false, nil
+		}
+
+		execution.BatchJob = running
+		service.Log.Infof("reattaching to running job %q in %q namespace",
+			execution.BatchJob.Name, execution.BatchJob.Namespace)
+
+		return true, nil
+	}
+
+	list, err := execution.Pods.List(ctx, options)
+
+	if err != nil {
+		return false, err
+	}
+
+	objects := map[string]runtime.Object{}
+
+	for i := range list.Items {
+		pod := &list.Items[i]
+
+		// pods of a Job are followed through the Job
+		if pod.DeletionTimestamp == nil && !podFinished(pod) &&
+			meta.GetControllerOf(pod) == nil {
+			objects[pod.Name] = pod
+		}
+	}
+
+	pod := newestPod(objects)
+
+	if pod == nil {
+		return false, nil
+	}
+
+	execution.Pod = pod
+	logPod(pod.Namespace, pod.Name)
+	service.Log.Infof("reattaching to running pod %q in %q namespace",
+		pod.Name, pod.Namespace)
+
+	return true, nil
+}
@@ -0,0 +1,158 @@
+package runner
+
+import (
+	"encoding/json"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/ayashkov/k8srun/service"
+	core "k8s.io/api/core/v1"
+)
+
+// Report is the summary of a run written by --report, so the runs can be
+// ingested by tools without scraping the logs
+type Report struct {
+	Instance   string           `json:"instance"`
+	Job        string           `json:"job"`
+	RunNumber  string           `json:"runNumber,omitempty"`
+	Machine    string           `json:"machine,omitempty"`
+	Template   *ReportObject    `json:"template,omitempty"`
+	BatchJob   *ReportObject    `json:"batchJob,omitempty"`
+	Pod        *ReportObject    `json:"pod,omitempty"`
+	Timestamps ReportTimestamps `json:"timestamps"`
+	ExitCode   int              `json:"exitCode"`
+	Reason     string           `json:"reason,omitempty"`
+	LogBytes   int64            `json:"logBytes"`
+	Errors     []string         `json:"errors,omitempty"`
+}
+
+type ReportObject struct {
+	Name            string `json:"name"`
+	Namespace       string `json:"namespace,omitempty"`
+	UID             string `json:"uid,omitempty"`
+	ResourceVersion string `json:"resourceVersion,omitempty"`
+	Node            string `json:"node,omitempty"`
+}
+
+type ReportTimestamps struct {
+	Created   *time.Time `json:"created,omitempty"`
+	Scheduled *time.Time `json:"scheduled,omitempty"`
+	Started   *time.Time `json:"started,omitempty"`
+	Finished  *time.Time `json:"finished,omitempty"`
+	Deleted   *time.Time `json:"deleted,omitempty"`
+}
+
+// byteCounter counts the bytes of the logs copied to dst
+type byteCounter struct {
+	dst   io.Writer
+	count atomic.Int64
+}
+
+func (counter *byteCounter) Write(p []byte) (int, error) {
+	n, err := counter.dst.Write(p)
+
+	counter.count.Add(int64(n))
+
+	return n, err
+}
+
+func newReport(job *Job, execution *Execution, exitCode int,
+	errs []error, logBytes int64) *Report {
+	report := &Report{
+		Instance:  job.Instance,
+		Job:       job.Name,
+		RunNumber: job.RunNumber,
+		Machine:   job.Machine,
+		ExitCode:  exitCode,
+		LogBytes:  logBytes,
+	}
+
+	for _, err := range errs {
+		if err != nil {
+			report.Errors = append(report.Errors, err.Error())
+		}
+	}
+
+	if len(errs) > 0 && errs[0] != nil {
+		report.ExitCode = ExitCode(errs[0])
+	}
+
+	if execution == nil {
+		return report
+	}
+
+	if template := execution.template; template != nil {
+		report.Template = &ReportObject{
+			Name:            template.Name,
+			Namespace:       template.Namespace,
+			ResourceVersion: template.ResourceVersion,
+		}
+	}
+
+	if batchJob := execution.BatchJob; batchJob != nil {
+		report.BatchJob = &ReportObject{
+			Name:      batchJob.Name,
+			Namespace: batchJob.Namespace,
+			UID:       string(batchJob.UID),
+		}
+	}
+
+	if deleted := execution.deletedAt(); !deleted.IsZero() {
+		report.Timestamps.Deleted = &deleted
+	}
+
+	pod := execution.lastPod()
+
+	if pod == nil || pod.Name == "" {
+		return report
+	}
+
+	report.Pod = &ReportObject{
+		Name:      pod.Name,
+		Namespace: pod.Namespace,
+		UID:       string(pod.UID),
+		Node:      pod.Spec.NodeName,
+	}
+	report.Reason = pod.Status.Reason
+
+	if !pod.CreationTimestamp.IsZero() {
+		report.Timestamps.Created = &pod.CreationTimestamp.Time
+	}
+
+	for i := range pod.Status.Conditions {
+		condition := &pod.Status.Conditions[i]
+
+		if condition.Type == core.PodScheduled &&
+			condition.Status == core.ConditionTrue {
+			report.Timestamps.Scheduled = &condition.LastTransitionTime.Time
+		}
+	}
+
+	status := containerStatus(pod, mainContainer(pod))
+
+	if status == nil {
+		return report
+	}
+
+	if running := status.State.Running; running != nil {
+		report.Timestamps.Started = &running.StartedAt.Time
+	}
+
+	if terminated := status.State.Terminated; terminated != nil {
+		report.Timestamps.Started = &terminated.StartedAt.Time
+		report.Timestamps.Finished = &terminated.FinishedAt.Time
+		report.Reason = terminated.Reason
+	}
+
+	return report
+}
+
+func writeReport(path string, report *Report) {
+	data, _ := json.MarshalIndent(report, "", "  ")
+
+	if err := os.WriteFile(path, append(data, '\n'), 0644); err != nil {
+		service.Log.Errorf("error writing report: %v", err)
+	}
+}
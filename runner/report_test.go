@@ -0,0 +1,127 @@
+package runner_test
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/ayashkov/k8srun/runner"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/kubernetes/fake"
+	k8sTesting "k8s.io/client-go/testing"
+)
+
+func readReport(t *testing.T, path string) *runner.Report {
+	data, err := os.ReadFile(path)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	report := &runner.Report{}
+
+	if err := json.Unmarshal(data, report); err != nil {
+		t.Fatal(err)
+	}
+
+	return report
+}
+
+// completePods makes the pods terminate with the exit code as soon as they
+// are created
+func completePods(clientset *fake.Clientset, exitCode int32,
+	scheduled meta.Time, started meta.Time, finished meta.Time) {
+	clientset.PrependReactor("create", "pods",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			pod := action.(k8sTesting.CreateAction).GetObject().(*core.Pod)
+
+			pod.CreationTimestamp = meta.NewTime(scheduled.Add(-time.Second))
+			pod.Spec.NodeName = "node"
+			pod.Status = core.PodStatus{
+				Phase: core.PodFailed,
+				Conditions: []core.PodCondition{{
+					Type:               core.PodScheduled,
+					Status:             core.ConditionTrue,
+					LastTransitionTime: scheduled,
+				}},
+				ContainerStatuses: []core.ContainerStatus{{
+					Name: "job",
+					State: core.ContainerState{
+						Terminated: &core.ContainerStateTerminated{
+							ExitCode:   exitCode,
+							Reason:     "Error",
+							StartedAt:  started,
+							FinishedAt: finished,
+						},
+					},
+				}},
+			}
+
+			return false, nil, nil
+		})
+}
+
+func Test_Runner_Run_WritesReport_WhenPodCompletes(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+	scheduled := meta.NewTime(time.Date(2026, 10, 18, 1, 0, 0, 0, time.UTC))
+	started := meta.NewTime(time.Date(2026, 10, 18, 1, 0, 5, 0, time.UTC))
+	finished := meta.NewTime(time.Date(2026, 10, 18, 1, 1, 0, 0, time.UTC))
+
+	template.ResourceVersion = "42"
+	job.RunNumber = "1234"
+	job.Report = filepath.Join(t.TempDir(), "report.json")
+
+	jobRunner, clientset := newRunner(t, template)
+
+	completePods(clientset, 3, scheduled, started, finished)
+
+	exitCode, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Nil(err)
+	assert.Equal(3, exitCode)
+
+	report := readReport(t, job.Report)
+
+	assert.Equal("ACE", report.Instance)
+	assert.Equal("TEST_JOB", report.Job)
+	assert.Equal("1234", report.RunNumber)
+	assert.Equal(&runner.ReportObject{Name: "template", Namespace: "namespace",
+		ResourceVersion: "42"}, report.Template)
+	assert.Equal(&runner.ReportObject{Name: "test-job-00001",
+		Namespace: "namespace", UID: "uid-1", Node: "node"}, report.Pod)
+	assert.True(scheduled.Add(-time.Second).Equal(*report.Timestamps.Created))
+	assert.True(scheduled.Time.Equal(*report.Timestamps.Scheduled))
+	assert.True(started.Time.Equal(*report.Timestamps.Started))
+	assert.True(finished.Time.Equal(*report.Timestamps.Finished))
+	assert.NotNil(report.Timestamps.Deleted)
+	assert.Equal(3, report.ExitCode)
+	assert.Equal("Error", report.Reason)
+	assert.Positive(report.LogBytes)
+	assert.Empty(report.Errors)
+}
+
+func Test_Runner_Run_WritesReportWithError_WhenTemplateIsMissing(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+	job := newJob()
+
+	job.Report = filepath.Join(t.TempDir(), "report.json")
+
+	_, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.NotNil(err)
+
+	report := readReport(t, job.Report)
+
+	assert.Equal(runner.ExitCode(err), report.ExitCode)
+	assert.Equal([]string{err.Error()}, report.Errors)
+	assert.Nil(report.Pod)
+	assert.Nil(report.Template)
+}
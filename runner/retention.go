@@ -0,0 +1,126 @@
+package runner
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"time"
+
+	"github.com/ayashkov/k8srun/service"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+)
+
+const KEEP_POD = "k8srun.yashkov.org/keep-pod"
+
+const RETAINED = "k8srun.yashkov.org/retained"
+
+const EXPIRES = "k8srun.yashkov.org/expires"
+
+const (
+	KEEP_NEVER      = "never"
+	KEEP_ON_FAILURE = "on-failure"
+	KEEP_ALWAYS     = "always"
+)
+
+func keepPolicy(template *core.PodTemplate, job *Job) (string, error) {
+	keep := job.KeepPod
+
+	if keep == "" {
+		keep = template.Annotations[KEEP_POD]
+	}
+
+	switch keep {
+	case "":
+		return KEEP_NEVER, nil
+	case KEEP_NEVER, KEEP_ON_FAILURE, KEEP_ALWAYS:
+		return keep, nil
+	}
+
+	return "", fmt.Errorf("unsupported keep pod policy %q, expected %q, %q "+
+		"or %q", keep, KEEP_NEVER, KEEP_ON_FAILURE, KEEP_ALWAYS)
+}
+
+// Finish deletes the pod or retains it for inspection, depending on the
+// keep pod policy and whether the run has failed
+func (execution *Execution) Finish(ctx context.Context, failed bool) error {
+	if execution.keep == KEEP_ALWAYS ||
+		(execution.keep == KEEP_ON_FAILURE && failed) {
+		return execution.Retain(ctx, execution.job().Retention)
+	}
+
+	return execution.Delete(ctx)
+}
+
+// Retain labels the pod, or the Job, as retained and annotates it with
+// its expiry time, so it survives the run and is cleaned up later
+func (execution *Execution) Retain(ctx context.Context,
+	retention time.Duration) error {
+	execution.release()
+
+	if execution.killed.Load() {
+		return nil
+	}
+
+	expires := time.Now().Add(retention).UTC().Format(time.RFC3339)
+	patch := map[string]any{
+		"metadata": map[string]any{
+			"labels":      map[string]string{RETAINED: "true"},
+			"annotations": map[string]string{EXPIRES: expires},
+		},
+	}
+
+	if execution.BatchJob != nil {
+		// the Job controller would delete the Job before it expires
+		patch["spec"] = map[string]any{
+			"ttlSecondsAfterFinished": int64(retention / time.Second),
+		}
+		data, _ := json.Marshal(patch)
+
+		_, err := execution.Jobs.Patch(ctx, execution.BatchJob.Name,
+			types.StrategicMergePatchType, data, meta.PatchOptions{})
+
+		if err != nil {
+			return fmt.Errorf("error retaining job %q in %q namespace: %w",
+				execution.BatchJob.Name, execution.BatchJob.Namespace, err)
+		}
+
+		service.Log.Infof("retained job %q in %q namespace until %v",
+			execution.BatchJob.Name, execution.BatchJob.Namespace, expires)
+
+		return nil
+	}
+
+	pod := execution.current()
+
+	if pod == nil {
+		return nil
+	}
+
+	data, _ := json.Marshal(patch)
+
+	_, err := execution.Pods.Patch(ctx, pod.Name, types.StrategicMergePatchType,
+		data, meta.PatchOptions{})
+
+	if err != nil {
+		return fmt.Errorf("error retaining pod %q in %q namespace: %w",
+			pod.Name, pod.Namespace, err)
+	}
+
+	service.Log.Infof("retained pod %q in %q namespace until %v",
+		pod.Name, pod.Namespace, expires)
+
+	return nil
+}
+
+func retainedSelector() string {
+	return labels.Set{MANAGED_BY: MANAGER, RETAINED: "true"}.String()
+}
+
+func expired(object meta.Object, now time.Time) bool {
+	expires, err := time.Parse(time.RFC3339, object.GetAnnotations()[EXPIRES])
+
+	return err == nil && now.After(expires)
+}
@@ -2,127 +2,444 @@ package runner
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"io"
 	"regexp"
 	"strings"
+	"time"
 
 	"github.com/ayashkov/k8srun/service"
 	core "k8s.io/api/core/v1"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
 	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/rest"
 )
 
 const INSTANCE = "k8srun.yashkov.org/instance"
 
 const PREFIX = "k8srun.yashkov.org/prefix"
 
+const CONTAINER = "k8srun.yashkov.org/container"
+
+const killMargin = 10 * time.Second
+
+var invalidNameChars = regexp.MustCompile("[^a-z0-9.-]+")
+
 type Runner interface {
 	Run(ctx context.Context, job *Job, out io.Writer) (int, error)
 	Start(ctx context.Context, job *Job) (*Execution, error)
+	Wait(ctx context.Context, handle string, job *Job) (int, error)
+	Logs(ctx context.Context, handle string, job *Job, out io.Writer) error
+	Status(ctx context.Context, handle string, job *Job, out io.Writer) error
+	Kill(ctx context.Context, handle string, job *Job) error
+	GC(ctx context.Context, options *GCOptions, out io.Writer) error
 }
 
 type defaultRunner struct {
 	clentset  kubernetes.Interface
+	config    *rest.Config
 	namespace string
+	metrics   *metrics
 }
 
 func (runner *defaultRunner) Start(ctx context.Context,
 	job *Job) (*Execution, error) {
+	logJob(job)
+
 	template, err := runner.getPodTemplate(ctx, job)
 
 	if err != nil {
 		return nil, err
 	}
 
-	execution := Execution{Job: job}
+	// nothing follows a detached pod to hold its slots while it runs, so
+	// they only admit it, waiting for a free slot before creating it
+	slots, err := runner.acquireSlots(ctx, job, template)
+
+	if err != nil {
+		return nil, err
+	}
+
+	defer releaseSlots(slots)
+
+	return runner.start(ctx, job, template)
+}
+
+// start creates the pod or the Job of the resolved template, or reattaches
+// to the one of a restarted run
+func (runner *defaultRunner) start(ctx context.Context, job *Job,
+	template *Template) (*Execution, error) {
+	execution, err := runner.build(ctx, job, template)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if !job.Fresh {
+		found, err := execution.reattach(ctx)
+
+		if err != nil {
+			return nil, err
+		}
+
+		if found {
+			return execution, nil
+		}
+	}
+
+	if err = execution.create(ctx, meta.CreateOptions{}); err != nil {
+		return nil, err
+	}
+
+	return execution, nil
+}
+
+// build prepares the pod or the Job of the resolved template to submit
+// without creating it
+func (runner *defaultRunner) build(ctx context.Context, job *Job,
+	template *Template) (*Execution, error) {
+	job = template.withDefaults(job)
+
+	backend, err := backend(template.PodTemplate, job)
+
+	if err != nil {
+		return nil, err
+	}
+
+	keep, err := keepPolicy(template.PodTemplate, job)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if _, err := eventsVerbosity(job); err != nil {
+		return nil, err
+	}
+
+	execution := Execution{Job: job, keep: keep,
+		template: template.PodTemplate}
 
 	execution.Pods = runner.clentset.CoreV1().Pods(template.Namespace)
+	execution.Events = runner.clentset.CoreV1().Events(template.Namespace)
 
 	def := &core.Pod{
-		ObjectMeta: template.Template.ObjectMeta,
-		Spec:       template.Template.Spec,
+		ObjectMeta: *template.Template.ObjectMeta.DeepCopy(),
+		Spec:       *template.Template.Spec.DeepCopy(),
 	}
 
 	def.ObjectMeta.Namespace = ""
 	def.ObjectMeta.Name = ""
 	def.ObjectMeta.GenerateName = generateName(job.Name)
-	def.Spec.Containers[0].Args = job.Args
 
-	execution.Pod, err = execution.Pods.Create(ctx, def, meta.CreateOptions{})
+	if err := checkOverrides(template, job); err != nil {
+		return nil, err
+	}
+
+	if err := applyPatches(def, job); err != nil {
+		return nil, err
+	}
+
+	main, err := mainContainerIndex(&def.Spec, template.Annotations[CONTAINER])
 
 	if err != nil {
+		return nil, fmt.Errorf("invalid patched pod: %w", err)
+	}
+
+	def.Spec.Containers[main].Args = job.Args
+
+	if def.ObjectMeta.Annotations == nil {
+		def.ObjectMeta.Annotations = map[string]string{}
+	}
+
+	def.ObjectMeta.Annotations[CONTAINER] = def.Spec.Containers[main].Name
+	def.ObjectMeta.Annotations[KEEP_POD] = keep
+
+	if job.Detached {
+		def.ObjectMeta.Annotations[DETACHED] = "true"
+	}
+
+	if err := applyOverrides(def, main, job); err != nil {
+		return nil, err
+	}
+
+	if err := expandPod(def, template.PodTemplate, job); err != nil {
+		return nil, err
+	}
+
+	if err := template.checkArgs(def.Spec.Containers[main].Args); err != nil {
 		return nil, err
 	}
 
-	service.Log.Infof("created pod %q in %q namespace",
-		execution.Pod.Name, execution.Pod.Namespace)
+	injectContext(def, main, job)
+
+	// the server side deadline is a backstop behind the timeout of the run,
+	// past the grace period of the kill, so the timeout is what is reported
+	if job.Timeout > 0 {
+		deadline := int64((job.Timeout + job.GracePeriod + killMargin) /
+			time.Second)
+
+		if def.Spec.ActiveDeadlineSeconds == nil ||
+			*def.Spec.ActiveDeadlineSeconds > deadline {
+			def.Spec.ActiveDeadlineSeconds = &deadline
+		}
+	}
+
+	if backend == BACKEND_JOB {
+		execution.Jobs = runner.clentset.BatchV1().Jobs(template.Namespace)
+		execution.BatchJob, err = newBatchJob(template.PodTemplate, def, job)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &execution, nil
+	}
+
+	execution.Pod = def
 
 	return &execution, nil
 }
 
 func (runner *defaultRunner) Run(ctx context.Context, job *Job,
-	out io.Writer) (int, error) {
-	execution, err := runner.Start(ctx, job)
+	out io.Writer) (exitCode int, err error) {
+	logJob(job)
+
+	if job.DryRun != "" {
+		return runner.dryRun(ctx, job, out)
+	}
+
+	var execution *Execution
+	var finishErr error
+
+	if job.MetricsDir != "" || job.MetricsURL != "" {
+		started := time.Now()
+
+		defer func() {
+			runner.recordRun(job, execution, started, exitCode, err)
+		}()
+	}
+
+	if job.Report != "" {
+		logs := &byteCounter{dst: out}
+
+		out = logs
+
+		defer func() {
+			writeReport(job.Report, newReport(job, execution, exitCode,
+				[]error{err, finishErr}, logs.count.Load()))
+		}()
+	}
+
+	if job.Lock != "" {
+		lease, err := runner.lock(ctx, job)
+
+		if err != nil {
+			return -1, err
+		}
+
+		defer lease.release()
+
+		// the run must not go on once another run has taken its lock over
+		var cancel context.CancelCauseFunc
+
+		ctx, cancel = context.WithCancelCause(ctx)
+
+		defer cancel(nil)
+
+		go func() {
+			select {
+			case <-lease.lost:
+				cancel(&ExitError{
+					Code: EXIT_LOCKED,
+					Err: fmt.Errorf("job %v lost its lock to %v, its pod was "+
+						"deleted", job.Name, lease.lostTo),
+				})
+			case <-ctx.Done():
+			}
+		}()
+	}
+
+	template, err := runner.getPodTemplate(ctx, job)
 
 	if err != nil {
+		if ctx.Err() != nil {
+			return -1, interrupted(ctx, ctx, job)
+		}
+
 		return -1, err
 	}
 
-	defer func() {
-		if err := execution.Delete(ctx); err != nil {
+	slots, err := runner.acquireSlots(ctx, job, template)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, interrupted(ctx, ctx, job)
+		}
+
+		return -1, err
+	}
+
+	defer releaseSlots(slots)
+
+	started, err := runner.start(ctx, job, template)
+
+	if err != nil {
+		if ctx.Err() != nil {
+			return -1, &ExitError{
+				Code: EXIT_KILLED,
+				Err:  fmt.Errorf("job %v was killed starting: %w", job.Name, err),
+			}
+		}
+
+		return -1, err
+	}
+
+	execution = started
+	job = execution.Job
+
+	// the kill path below is armed only now, so a termination signal
+	// received while the pod was created or reattached is handled here
+	if ctx.Err() != nil {
+		if err := execution.Kill(context.Background(),
+			job.GracePeriod); err != nil {
+			service.Log.Error(err)
+		}
+
+		return -1, interrupted(ctx, ctx, job)
+	}
+
+	heartbeat, err := runner.heartbeat(ctx, job, execution)
+
+	if err != nil {
+		// an unfollowed pod would be reaped by gc while it runs, so the run
+		// fails rather than leaving it behind
+		if err := execution.Kill(context.Background(),
+			job.GracePeriod); err != nil {
 			service.Log.Error(err)
 		}
+
+		return -1, err
+	}
+
+	defer heartbeat.release()
+
+	runCtx := ctx
+
+	if job.Timeout > 0 {
+		var cancel context.CancelFunc
+
+		runCtx, cancel = context.WithTimeout(ctx, job.Timeout)
+
+		defer cancel()
+	}
+
+	// the execution must outlive runCtx, so the pod can be killed and its
+	// last log lines collected after a termination signal or a timeout
+	execCtx, cancel := context.WithCancel(context.Background())
+
+	defer cancel()
+
+	go func() {
+		select {
+		case <-runCtx.Done():
+			if err := execution.Kill(execCtx, job.GracePeriod); err != nil {
+				service.Log.Error(err)
+			}
+
+			time.AfterFunc(job.GracePeriod+killMargin, cancel)
+		case <-execCtx.Done():
+		}
 	}()
 
-	err = execution.CopyLogs(ctx, out)
+	defer func() {
+		failed := exitCode != 0 || err != nil
+
+		if finishErr = execution.Finish(context.Background(),
+			failed); finishErr != nil {
+			service.Log.Error(finishErr)
+		}
+	}()
+
+	err = execution.CopyLogs(execCtx, out)
+
+	if err := interrupted(ctx, runCtx, job); err != nil {
+		return -1, err
+	}
 
 	if err != nil {
 		return -1, err
 	}
 
-	return execution.WaitForCompletion(ctx)
+	exitCode, err = execution.WaitForCompletion(execCtx)
+
+	if err := interrupted(ctx, runCtx, job); err != nil {
+		return -1, err
+	}
+
+	return exitCode, err
+}
+
+func (runner *defaultRunner) jobNamespace(job *Job) string {
+	if job.Namespace == "" {
+		return runner.namespace
+	}
+
+	return job.Namespace
 }
 
 func (runner *defaultRunner) getPodTemplate(ctx context.Context,
-	job *Job) (*core.PodTemplate, error) {
-	namespace := job.Namespace
+	job *Job) (*Template, error) {
+	source, err := runner.templateSource(job)
 
-	if namespace == "" {
-		namespace = runner.namespace
+	if err != nil {
+		return nil, err
 	}
 
-	template, err := runner.clentset.
-		CoreV1().
-		PodTemplates(namespace).
-		Get(ctx, job.Template, meta.GetOptions{})
+	template, err := source.Get(ctx, runner.jobNamespace(job), job.Template)
 
 	if err != nil {
 		return nil, err
 	}
 
-	if err = checkAnnotation(template, INSTANCE,
-		strings.ToLower(job.Instance)); err != nil {
+	template, err = inherit(ctx, source, runner.jobNamespace(job), template)
+
+	if err != nil {
 		return nil, err
 	}
 
-	if err = checkAnnotation(template, PREFIX, prefix(job.Name)); err != nil {
+	if err = template.check(job); err != nil {
 		return nil, err
 	}
 
-	if nConts := len(template.Template.Spec.Containers); nConts != 1 {
-		return nil,
-			fmt.Errorf("only one container per pod is supported, %q has %v",
-				template.Name, nConts)
+	if _, err := mainContainerIndex(&template.Template.Spec,
+		template.Annotations[CONTAINER]); err != nil {
+		return nil, fmt.Errorf("invalid template %q: %w", template.Name, err)
 	}
 
 	return template, nil
 }
 
-func checkAnnotation(template *core.PodTemplate, name string, value string) error {
-	if strings.ToLower(template.Annotations[name]) != value {
-		return fmt.Errorf("template annotation %v does not match %q",
-			name, value)
+func interrupted(ctx context.Context, runCtx context.Context, job *Job) error {
+	var exitErr *ExitError
+
+	if errors.As(context.Cause(ctx), &exitErr) {
+		return exitErr
+	}
+
+	if ctx.Err() != nil {
+		return &ExitError{
+			Code: EXIT_KILLED,
+			Err:  fmt.Errorf("job %v was killed, its pod was deleted", job.Name),
+		}
+	}
+
+	if runCtx.Err() != nil {
+		return &ExitError{
+			Code: EXIT_RUN_TIMEOUT,
+			Err: fmt.Errorf("job %v did not finish within %v, its pod was deleted",
+				job.Name, job.Timeout),
+		}
 	}
 
 	return nil
@@ -135,6 +452,12 @@ func prefix(name string) string {
 }
 
 func generateName(s string) string {
-	return strings.ReplaceAll(strings.TrimSpace(strings.ToLower(s)), "_",
-		"-") + "-"
+	name := strings.Trim(invalidNameChars.ReplaceAllString(
+		strings.TrimSpace(strings.ToLower(s)), "-"), "-.")
+
+	if len(name) > 57 {
+		name = strings.TrimRight(name[:57], "-.")
+	}
+
+	return name + "-"
 }
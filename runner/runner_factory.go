@@ -1,6 +1,8 @@
 package runner
 
 import (
+	"net/http"
+
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -35,6 +37,12 @@ func (factory *defaultRunnerFactory) New(kubeconfig string) (Runner, error) {
 		return nil, err
 	}
 
+	metrics := newMetrics()
+
+	restConfig.Wrap(func(next http.RoundTripper) http.RoundTripper {
+		return &apiErrors{metrics: metrics, next: next}
+	})
+
 	clientset, err := Client.NewClientset(restConfig)
 
 	if err != nil {
@@ -43,6 +51,8 @@ func (factory *defaultRunnerFactory) New(kubeconfig string) (Runner, error) {
 
 	return &defaultRunner{
 		clentset:  clientset,
+		config:    restConfig,
 		namespace: namespace,
+		metrics:   metrics,
 	}, nil
 }
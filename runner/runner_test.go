@@ -1,9 +1,14 @@
 package runner_test
 
 import (
+	"bytes"
 	"context"
+	"crypto/sha256"
 	"fmt"
+	"os"
+	"path/filepath"
 	"testing"
+	"time"
 
 	"github.com/ayashkov/k8srun/mock"
 	"github.com/ayashkov/k8srun/runner"
@@ -12,9 +17,16 @@ import (
 	"github.com/sirupsen/logrus"
 	"github.com/sirupsen/logrus/hooks/test"
 	"github.com/stretchr/testify/assert"
+	batch "k8s.io/api/batch/v1"
+	coordination "k8s.io/api/coordination/v1"
 	core "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/errors"
 	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
 	"k8s.io/client-go/rest"
+	k8sTesting "k8s.io/client-go/testing"
 	"k8s.io/client-go/tools/clientcmd"
 )
 
@@ -200,3 +212,1307 @@ func Test_Execution_Delete_ReturnsError_WhenDeleteFails(t *testing.T) {
 
 	assert.Empty(logger.Entries)
 }
+
+func Test_Execution_Kill_DeletesPodWithGracePeriod_WhenPodIsProvided(t *testing.T) {
+	assert := setUp(t)
+	pods := mock.NewMockPodInterface(gomock.NewController(t))
+	execution := runner.Execution{
+		Pod: &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      "kill-me",
+				Namespace: "namespace",
+			},
+		},
+		Pods: pods,
+	}
+	seconds := int64(15)
+
+	pods.EXPECT().
+		Delete(ctx, "kill-me", meta.DeleteOptions{GracePeriodSeconds: &seconds})
+
+	assert.Nil(execution.Kill(ctx, 15*time.Second))
+	assert.Nil(execution.Kill(ctx, 15*time.Second))
+	assert.Nil(execution.Delete(ctx))
+
+	assert.Equal(1, len(logger.Entries))
+	assert.Equal(logrus.InfoLevel, logger.LastEntry().Level)
+	assert.Equal(
+		"killing pod \"kill-me\" in \"namespace\" namespace, grace period 15s",
+		logger.LastEntry().Message)
+}
+
+func Test_Execution_Delete_IgnoresError_WhenPodIsGone(t *testing.T) {
+	assert := setUp(t)
+	pods := mock.NewMockPodInterface(gomock.NewController(t))
+	execution := runner.Execution{
+		Pod: &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      "delete-me",
+				Namespace: "namespace",
+			},
+		},
+		Pods: pods,
+	}
+
+	pods.EXPECT().
+		Delete(ctx, "delete-me", meta.DeleteOptions{}).
+		Return(errors.NewNotFound(core.Resource("pods"), "delete-me"))
+
+	assert.Nil(execution.Delete(ctx))
+	assert.Nil(execution.Pod)
+}
+
+func Test_ExitCode_ReturnsCode_WhenExitError(t *testing.T) {
+	assert := setUp(t)
+
+	assert.Equal(runner.EXIT_KILLED, runner.ExitCode(fmt.Errorf("wrapped: %w",
+		&runner.ExitError{Code: runner.EXIT_KILLED, Err: fmt.Errorf("killed")})))
+	assert.Equal(runner.EXIT_ERROR, runner.ExitCode(fmt.Errorf("other")))
+}
+
+func newRunner(t *testing.T, objects ...runtime.Object) (runner.Runner,
+	*fake.Clientset) {
+	clientset := fake.NewSimpleClientset(objects...)
+	generated := 0
+
+	clientset.PrependReactor("create", "*",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			object := action.(k8sTesting.CreateAction).GetObject().(meta.Object)
+
+			if object.GetName() == "" {
+				generated++
+				object.SetName(fmt.Sprintf("%v%05d", object.GetGenerateName(),
+					generated))
+				object.SetUID(types.UID(fmt.Sprintf("uid-%v", generated)))
+			}
+
+			return false, nil, nil
+		})
+	mockClient.EXPECT().
+		NewClientConfig(gomock.Any(), gomock.Any()).
+		Return(clientConfig)
+	clientConfig.EXPECT().
+		Namespace().
+		Return("namespace", false, nil)
+	clientConfig.EXPECT().
+		ClientConfig().
+		Return(&rest.Config{}, nil)
+	mockClient.EXPECT().
+		NewClientset(gomock.Any()).
+		Return(clientset, nil)
+
+	runner, err := factory.New("")
+
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return runner, clientset
+}
+
+func newTemplate(name string) *core.PodTemplate {
+	return &core.PodTemplate{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      name,
+			Namespace: "namespace",
+			Annotations: map[string]string{
+				runner.INSTANCE: "ace",
+				runner.PREFIX:   "test",
+			},
+		},
+		Template: core.PodTemplateSpec{
+			Spec: core.PodSpec{
+				Containers: []core.Container{{Name: "job", Image: "alpine"}},
+			},
+		},
+	}
+}
+
+func newJob() *runner.Job {
+	return &runner.Job{
+		Instance: "ACE",
+		Name:     "TEST_JOB",
+		Template: "template",
+		Args:     []string{"ls"},
+	}
+}
+
+func Test_Runner_Run_DeletesPod_WhenTimeoutExpires(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.Timeout = 50 * time.Millisecond
+
+	exitCode, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.EqualError(err,
+		"job TEST_JOB did not finish within 50ms, its pod was deleted")
+	assert.Equal(runner.EXIT_RUN_TIMEOUT, runner.ExitCode(err))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Run_DeletesPod_WhenKilled(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	killCtx, kill := context.WithCancel(ctx)
+
+	time.AfterFunc(50*time.Millisecond, kill)
+
+	exitCode, err := jobRunner.Run(killCtx, newJob(), new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.EqualError(err, "job TEST_JOB was killed, its pod was deleted")
+	assert.Equal(runner.EXIT_KILLED, runner.ExitCode(err))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Run_DeletesPod_WhenKilledWhileCreatingIt(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	killCtx, kill := context.WithCancel(ctx)
+
+	clientset.PrependReactor("create", "pods",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			kill()
+
+			return false, nil, nil
+		})
+	// the heartbeat requests made with the killed context fail, as with a
+	// real client
+	clientset.PrependReactor("*", "leases",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			if killCtx.Err() != nil {
+				return true, nil, killCtx.Err()
+			}
+
+			return false, nil, nil
+		})
+
+	exitCode, err := jobRunner.Run(killCtx, newJob(), new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.EqualError(err, "job TEST_JOB was killed, its pod was deleted")
+	assert.Equal(runner.EXIT_KILLED, runner.ExitCode(err))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Start_SuppliesArgsToMainContainer_WhenAnnotated(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.CONTAINER] = "main"
+	template.Template.Spec.Containers = []core.Container{
+		{Name: "proxy", Image: "envoy"},
+		{Name: "main", Image: "alpine"},
+	}
+
+	jobRunner, _ := newRunner(t, template)
+	execution, err := jobRunner.Start(ctx, newJob())
+
+	assert.Nil(err)
+	assert.Empty(execution.Pod.Spec.Containers[0].Args)
+	assert.Equal([]string{"ls"}, execution.Pod.Spec.Containers[1].Args)
+	assert.Equal("main", execution.Pod.Annotations[runner.CONTAINER])
+}
+
+func Test_Runner_Start_ReturnsError_WhenMainContainerIsMissing(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.CONTAINER] = "main"
+
+	jobRunner, _ := newRunner(t, template)
+	_, err := jobRunner.Start(ctx, newJob())
+
+	assert.EqualError(err,
+		"invalid template \"template\": no container named \"main\"")
+}
+
+func Test_Runner_Start_CreatesJob_WhenJobBackend(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.BACKEND] = runner.BACKEND_JOB
+	template.Annotations[runner.BACKOFF_LIMIT] = "3"
+
+	jobRunner, _ := newRunner(t, template)
+	job := newJob()
+
+	job.Timeout = time.Hour
+	job.GracePeriod = 30 * time.Second
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Nil(execution.Pod)
+
+	spec := execution.BatchJob.Spec
+
+	assert.Equal("test-job-00001", execution.BatchJob.Name)
+	assert.Equal(int32(3), *spec.BackoffLimit)
+	assert.Equal(int32(3600), *spec.TTLSecondsAfterFinished)
+	assert.Equal(int64(3640), *spec.ActiveDeadlineSeconds)
+	assert.Nil(spec.Template.Spec.ActiveDeadlineSeconds)
+	assert.Equal(core.RestartPolicyNever, spec.Template.Spec.RestartPolicy)
+	assert.Equal([]string{"ls"}, spec.Template.Spec.Containers[0].Args)
+}
+
+func Test_Runner_Start_ReturnsError_WhenBackendIsUnknown(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.Backend = "deployment"
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err,
+		"unsupported backend \"deployment\", expected \"pod\" or \"job\"")
+}
+
+func Test_Execution_ReportsFinalAttempt_WhenJobBackend(t *testing.T) {
+	assert := setUp(t)
+	batchJob := &batch.Job{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      "test-job",
+			Namespace: "namespace",
+			UID:       "uid-1",
+		},
+		Status: batch.JobStatus{
+			Conditions: []batch.JobCondition{{
+				Type:   batch.JobFailed,
+				Status: core.ConditionTrue,
+				Reason: "BackoffLimitExceeded",
+			}},
+		},
+	}
+	attempt := func(name string, minute int, exitCode int32) *core.Pod {
+		return &core.Pod{
+			ObjectMeta: meta.ObjectMeta{
+				Name:              name,
+				Namespace:         "namespace",
+				Labels:            map[string]string{"controller-uid": "uid-1"},
+				CreationTimestamp: meta.Date(2023, 4, 1, 0, minute, 0, 0, time.UTC),
+			},
+			Spec: core.PodSpec{
+				Containers: []core.Container{{Name: "job"}},
+			},
+			Status: core.PodStatus{
+				Phase: core.PodFailed,
+				ContainerStatuses: []core.ContainerStatus{{
+					Name: "job",
+					State: core.ContainerState{
+						Terminated: &core.ContainerStateTerminated{
+							ExitCode: exitCode,
+						},
+					},
+				}},
+			},
+		}
+	}
+	clientset := fake.NewSimpleClientset(batchJob, attempt("test-job-1", 1, 2),
+		attempt("test-job-2", 2, 3))
+	execution := runner.Execution{
+		Job:      &runner.Job{},
+		Pods:     clientset.CoreV1().Pods("namespace"),
+		Jobs:     clientset.BatchV1().Jobs("namespace"),
+		BatchJob: batchJob,
+	}
+	out := new(bytes.Buffer)
+
+	assert.Nil(execution.CopyLogs(ctx, out))
+
+	exitCode, err := execution.WaitForCompletion(ctx)
+
+	assert.Nil(err)
+	assert.Equal(3, exitCode)
+	assert.Equal("test-job-2", execution.Pod.Name)
+	assert.Equal("fake logs", out.String())
+	assert.Nil(execution.Delete(ctx))
+
+	_, err = clientset.BatchV1().Jobs("namespace").Get(ctx, "test-job",
+		meta.GetOptions{})
+
+	assert.True(errors.IsNotFound(err))
+}
+
+func Test_Runner_Start_InjectsAutoSysContext_Normally(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Template.Spec.Containers[0].Env = []core.EnvVar{
+		{Name: "AUTORUN", Value: "template"},
+		{Name: "OTHER", Value: "value"},
+	}
+
+	jobRunner, _ := newRunner(t, template)
+	job := newJob()
+
+	job.Name = "TEST_JOB#With Spaces"
+	job.RunNumber = "1234"
+	job.Machine = "agent01"
+	job.Env = map[string]string{"AUTOUSER": "autosys"}
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal([]core.EnvVar{
+		{Name: "AUTORUN", Value: "1234"},
+		{Name: "OTHER", Value: "value"},
+		{Name: "AUTOSERV", Value: "ACE"},
+		{Name: "AUTOUSER", Value: "autosys"},
+		{Name: "AUTO_JOB_NAME", Value: "TEST_JOB#With Spaces"},
+		{Name: "AUTO_MACHINE", Value: "agent01"},
+	}, execution.Pod.Spec.Containers[0].Env)
+	assert.Equal(map[string]string{
+		runner.MANAGED_BY: "k8srun",
+		runner.INSTANCE:   "ace",
+		runner.JOB:        "test_job-with-spaces",
+		runner.RUN:        "1234",
+		runner.RUN_KEY:    "a3f07da2d55fc9c740d2350e703e6ca099bfa5be",
+	}, execution.Pod.Labels)
+	assert.Equal("ACE", execution.Pod.Annotations[runner.INSTANCE])
+	assert.Equal("TEST_JOB#With Spaces", execution.Pod.Annotations[runner.JOB_NAME])
+	assert.Equal("1234", execution.Pod.Annotations[runner.RUN])
+	assert.Equal("agent01", execution.Pod.Annotations[runner.MACHINE])
+}
+
+func Test_Runner_Start_SanitizesPodName_WhenJobNameHasSpecialCharacters(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.Name = "TEST_JOB#With Spaces"
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal("test-job-with-spaces-", execution.Pod.GenerateName)
+}
+
+func Test_Runner_Run_PrintsPod_WhenClientDryRun(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	job := newJob()
+	out := new(bytes.Buffer)
+
+	job.DryRun = runner.DRY_RUN_CLIENT
+
+	exitCode, err := jobRunner.Run(ctx, job, out)
+
+	assert.Nil(err)
+	assert.Equal(0, exitCode)
+	assert.Contains(out.String(), "apiVersion: v1\nkind: Pod\n")
+	assert.Contains(out.String(), "  generateName: test-job-\n")
+	assert.Contains(out.String(), "  - args:\n    - ls\n")
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Run_PrintsSubmittedPod_WhenServerDryRun(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	job := newJob()
+	out := new(bytes.Buffer)
+
+	clientset.PrependReactor("create", "pods",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			pod := action.(k8sTesting.CreateAction).GetObject().(*core.Pod)
+
+			pod.Spec.NodeName = "admitted"
+
+			return true, pod, nil
+		})
+
+	job.DryRun = runner.DRY_RUN_SERVER
+	job.Output = runner.OUTPUT_JSON
+
+	exitCode, err := jobRunner.Run(ctx, job, out)
+
+	assert.Nil(err)
+	assert.Equal(0, exitCode)
+	assert.Contains(out.String(), "\"kind\": \"Pod\"")
+	assert.Contains(out.String(), "\"nodeName\": \"admitted\"")
+
+	messages := []string{}
+
+	for _, entry := range logger.AllEntries() {
+		assert.NotContains(entry.Message, "created pod")
+		messages = append(messages, entry.Message)
+	}
+
+	assert.Contains(messages, "dry run (server) of job TEST_JOB succeeded")
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Run_ReturnsError_WhenDryRunIsUnknown(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.DryRun = "none"
+
+	_, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.EqualError(err,
+		"unsupported dry run \"none\", expected \"client\" or \"server\"")
+}
+
+func Test_Execution_Finish_RetainsPod_WhenFailedAndKeepOnFailure(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+
+	template.Annotations[runner.KEEP_POD] = runner.KEEP_ON_FAILURE
+	job.Retention = time.Hour
+
+	jobRunner, clientset := newRunner(t, template)
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Nil(execution.Finish(ctx, true))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Len(pods.Items, 1)
+	assert.Equal("true", pods.Items[0].Labels[runner.RETAINED])
+
+	expires, err := time.Parse(time.RFC3339,
+		pods.Items[0].Annotations[runner.EXPIRES])
+
+	assert.Nil(err)
+	assert.WithinDuration(time.Now().Add(time.Hour), expires, time.Minute)
+}
+
+func Test_Execution_Finish_DeletesPod_WhenSucceededAndKeepOnFailure(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.KeepPod = runner.KEEP_ON_FAILURE
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Nil(execution.Finish(ctx, false))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Start_ReturnsError_WhenKeepPodIsUnknown(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.KeepPod = "sometimes"
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "unsupported keep pod policy \"sometimes\", "+
+		"expected \"never\", \"on-failure\" or \"always\"")
+}
+
+func retainedPod(name string, expires time.Time) *core.Pod {
+	return &core.Pod{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      name,
+			Namespace: "namespace",
+			Labels: map[string]string{
+				runner.MANAGED_BY: runner.MANAGER,
+				runner.RETAINED:   "true",
+			},
+			Annotations: map[string]string{
+				runner.EXPIRES: expires.UTC().Format(time.RFC3339),
+			},
+		},
+	}
+}
+
+func Test_Runner_GC_DeletesExpiredPods_Normally(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t,
+		retainedPod("expired", time.Now().Add(-time.Minute)),
+		retainedPod("retained", time.Now().Add(time.Hour)))
+	out := new(bytes.Buffer)
+
+	assert.Nil(jobRunner.GC(ctx, &runner.GCOptions{}, out))
+	assert.Equal("deleted pod \"expired\" in \"namespace\" namespace: "+
+		"its retention has expired\n", out.String())
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Len(pods.Items, 1)
+	assert.Equal("retained", pods.Items[0].Name)
+}
+
+func Test_Runner_Run_KeepsExpiredPods_ForGC(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"),
+		retainedPod("expired", time.Now().Add(-time.Minute)))
+	job := newJob()
+
+	job.Timeout = 50 * time.Millisecond
+
+	_, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(runner.EXIT_RUN_TIMEOUT, runner.ExitCode(err))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Len(pods.Items, 1)
+	assert.Equal("expired", pods.Items[0].Name)
+}
+
+func Test_Runner_Start_ReattachesToRunningPod_WhenRunIsRestarted(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.RunNumber = "1234"
+
+	first, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal(first.Pod.Name, execution.Pod.Name)
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Len(pods.Items, 1)
+}
+
+func Test_Runner_Start_CreatesPod_WhenFreshRunIsRequested(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.RunNumber = "1234"
+
+	first, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+
+	job.Fresh = true
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.NotEqual(first.Pod.Name, execution.Pod.Name)
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Len(pods.Items, 2)
+}
+
+func Test_Runner_Start_CreatesPod_WhenPreviousRunHasFinished(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.RunNumber = "1234"
+
+	first, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+
+	first.Pod.Status.Phase = core.PodSucceeded
+	_, err = clientset.CoreV1().Pods("namespace").
+		UpdateStatus(ctx, first.Pod, meta.UpdateOptions{})
+
+	assert.Nil(err)
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.NotEqual(first.Pod.Name, execution.Pod.Name)
+}
+
+func heldLease(holder string, renewed time.Time) *coordination.Lease {
+	seconds := int32(30)
+	renewTime := meta.NewMicroTime(renewed)
+
+	return &coordination.Lease{
+		ObjectMeta: meta.ObjectMeta{
+			Name: fmt.Sprintf("k8srun-%x",
+				sha256.Sum256([]byte("ace/TEST_JOB")))[:47],
+			Namespace: "namespace",
+		},
+		Spec: coordination.LeaseSpec{
+			HolderIdentity:       &holder,
+			LeaseDurationSeconds: &seconds,
+			RenewTime:            &renewTime,
+		},
+	}
+}
+
+func Test_Runner_Run_Fails_WhenLockIsHeld(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"),
+		heldLease("ACE/TEST_JOB/1", time.Now()))
+	job := newJob()
+
+	job.Lock = runner.LOCK_FAIL
+
+	exitCode, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.EqualError(err, "job TEST_JOB is locked by ACE/TEST_JOB/1")
+	assert.Equal(runner.EXIT_LOCKED, runner.ExitCode(err))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Run_Skips_WhenLockIsHeld(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, newTemplate("template"),
+		heldLease("ACE/TEST_JOB/1", time.Now()))
+	job := newJob()
+
+	job.Lock = runner.LOCK_SKIP
+
+	_, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(runner.EXIT_SKIPPED, runner.ExitCode(err))
+}
+
+func Test_Runner_Run_WaitsForLock_UntilKilled(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"),
+		heldLease("ACE/TEST_JOB/1", time.Now()))
+	job := newJob()
+	killCtx, kill := context.WithCancel(ctx)
+
+	job.Lock = runner.LOCK_WAIT
+
+	time.AfterFunc(50*time.Millisecond, kill)
+
+	started := time.Now()
+	exitCode, err := jobRunner.Run(killCtx, job, new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.EqualError(err, "job TEST_JOB was killed waiting for its lock")
+	assert.Equal(runner.EXIT_KILLED, runner.ExitCode(err))
+	assert.GreaterOrEqual(time.Since(started), 50*time.Millisecond)
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Run_DeletesPod_WhenLockIsTakenOver(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	job := newJob()
+	lockName := heldLease("", time.Now()).Name
+
+	clientset.PrependReactor("update", "leases",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			lease := action.(k8sTesting.UpdateAction).GetObject().(*coordination.Lease)
+
+			if lease.Name != lockName {
+				return false, nil, nil
+			}
+
+			// another run takes the lock over between two renewals
+			taken := heldLease("ACE/TEST_JOB/2", time.Now())
+
+			if err := clientset.Tracker().Update(coordination.
+				SchemeGroupVersion.WithResource("leases"), taken,
+				"namespace"); err != nil {
+				t.Fatal(err)
+			}
+
+			return true, nil, errors.NewConflict(coordination.
+				Resource("leases"), lease.Name, fmt.Errorf("modified"))
+		})
+
+	job.Lock = runner.LOCK_FAIL
+	job.RunNumber = "1"
+	job.Timeout = time.Minute
+
+	exitCode, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.EqualError(err, "job TEST_JOB lost its lock to ACE/TEST_JOB/2, "+
+		"its pod was deleted")
+	assert.Equal(runner.EXIT_LOCKED, runner.ExitCode(err))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+
+	lease, err := clientset.CoordinationV1().Leases("namespace").
+		Get(ctx, lockName, meta.GetOptions{})
+
+	assert.Nil(err)
+	assert.Equal("ACE/TEST_JOB/2", *lease.Spec.HolderIdentity)
+}
+
+func Test_Runner_Run_TakesOverAndReleasesLock_WhenLockHasExpired(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"),
+		heldLease("ACE/TEST_JOB/1", time.Now().Add(-time.Hour)))
+	job := newJob()
+	holders := []string{}
+
+	clientset.PrependReactor("update", "leases",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			lease := action.(k8sTesting.UpdateAction).GetObject().(*coordination.Lease)
+
+			holders = append(holders, *lease.Spec.HolderIdentity)
+
+			return false, nil, nil
+		})
+
+	job.Lock = runner.LOCK_FAIL
+	job.RunNumber = "2"
+	job.Timeout = 50 * time.Millisecond
+
+	_, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(runner.EXIT_RUN_TIMEOUT, runner.ExitCode(err))
+	assert.Equal([]string{"ACE/TEST_JOB/2"}, holders)
+
+	leases, _ := clientset.CoordinationV1().Leases("namespace").
+		List(ctx, meta.ListOptions{})
+
+	assert.Empty(leases.Items)
+}
+
+func heldSlot(scope string, i int) *coordination.Lease {
+	lease := heldLease("ACE/OTHER_JOB/1", time.Now())
+	sum := sha256.Sum256([]byte(scope))
+
+	lease.Name = fmt.Sprintf("k8srun-slot-%x-%v", sum[:10], i)
+
+	return lease
+}
+
+func Test_Runner_Run_ReturnsQueueTimeout_WhenTemplateSlotsAreTaken(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.CONCURRENCY] = "1"
+
+	jobRunner, clientset := newRunner(t, template,
+		heldSlot("template template", 0))
+	job := newJob()
+
+	job.QueueTimeout = 50 * time.Millisecond
+
+	exitCode, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.EqualError(err, "job TEST_JOB did not get a free slot of "+
+		"template template within 50ms")
+	assert.Equal(runner.EXIT_QUEUE_TIMEOUT, runner.ExitCode(err))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Run_ReturnsKilled_WhenKilledWaitingForSlot(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	killCtx, kill := context.WithCancel(ctx)
+
+	template.Annotations[runner.CONCURRENCY] = "1"
+
+	jobRunner, clientset := newRunner(t, template,
+		heldSlot("template template", 0))
+
+	time.AfterFunc(50*time.Millisecond, kill)
+
+	exitCode, err := jobRunner.Run(killCtx, newJob(), new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.Equal(runner.EXIT_KILLED, runner.ExitCode(err))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Run_ReturnsKilled_WhenKilledGettingTemplate(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"))
+	killCtx, kill := context.WithCancel(ctx)
+
+	// the template request made with the killed context fails, as with a
+	// real client
+	clientset.PrependReactor("get", "podtemplates",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			kill()
+
+			return true, nil, killCtx.Err()
+		})
+
+	exitCode, err := jobRunner.Run(killCtx, newJob(), new(bytes.Buffer))
+
+	assert.Equal(-1, exitCode)
+	assert.Equal(runner.EXIT_KILLED, runner.ExitCode(err))
+}
+
+func Test_Runner_Start_ReturnsQueueTimeout_WhenTemplateSlotsAreTaken(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.CONCURRENCY] = "1"
+
+	jobRunner, clientset := newRunner(t, template,
+		heldSlot("template template", 0))
+	job := newJob()
+
+	job.Detached = true
+	job.QueueTimeout = 50 * time.Millisecond
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "job TEST_JOB did not get a free slot of "+
+		"template template within 50ms")
+	assert.Equal(runner.EXIT_QUEUE_TIMEOUT, runner.ExitCode(err))
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Start_ReleasesSlot_WhenPodIsCreated(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.CONCURRENCY] = "1"
+
+	jobRunner, clientset := newRunner(t, template)
+	job := newJob()
+
+	job.Detached = true
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.NotNil(execution.Pod)
+
+	leases, _ := clientset.CoordinationV1().Leases("namespace").
+		List(ctx, meta.ListOptions{})
+
+	assert.Empty(leases.Items)
+}
+
+func Test_Runner_Run_HoldsAndReleasesSlot_WhenInstanceIsLimited(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t, newTemplate("template"),
+		&core.ConfigMap{
+			ObjectMeta: meta.ObjectMeta{
+				Name:      runner.CONCURRENCY_CONFIG_MAP,
+				Namespace: "namespace",
+			},
+			Data: map[string]string{"ace": "2"},
+		},
+		heldSlot("instance ace", 0))
+	job := newJob()
+	created := []string{}
+
+	clientset.PrependReactor("create", "leases",
+		func(action k8sTesting.Action) (bool, runtime.Object, error) {
+			lease := action.(k8sTesting.CreateAction).GetObject().(*coordination.Lease)
+
+			created = append(created, lease.Name)
+
+			return false, nil, nil
+		})
+
+	job.Timeout = 50 * time.Millisecond
+
+	_, err := jobRunner.Run(ctx, job, new(bytes.Buffer))
+
+	assert.Equal(runner.EXIT_RUN_TIMEOUT, runner.ExitCode(err))
+	assert.Contains(created, heldSlot("instance ace", 1).Name)
+
+	gets := 0
+
+	for _, action := range clientset.Actions() {
+		if action.Matches("get", "podtemplates") {
+			gets++
+		}
+	}
+
+	assert.Equal(1, gets)
+
+	leases, _ := clientset.CoordinationV1().Leases("namespace").
+		List(ctx, meta.ListOptions{})
+
+	assert.Len(leases.Items, 1)
+}
+
+func Test_Runner_Run_ReturnsError_WhenConcurrencyIsInvalid(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.CONCURRENCY] = "none"
+
+	jobRunner, _ := newRunner(t, template)
+
+	_, err := jobRunner.Run(ctx, newJob(), new(bytes.Buffer))
+
+	assert.EqualError(err, "template annotation k8srun.yashkov.org/concurrency "+
+		"must be a positive integer, got \"none\"")
+}
+
+func Test_Runner_Start_AcceptsRun_WhenAnnotationListsMatchingRules(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.INSTANCE] = "dev, qa, ace"
+	template.Annotations[runner.PREFIX] = "/prod_.*/, test_*"
+
+	jobRunner, _ := newRunner(t, template)
+	_, err := jobRunner.Start(ctx, newJob())
+
+	assert.Nil(err)
+}
+
+func Test_Runner_Start_AcceptsRun_WhenPrefixRegexMatchesJobName(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.PREFIX] = "/test_(job|other)/"
+
+	jobRunner, _ := newRunner(t, template)
+	_, err := jobRunner.Start(ctx, newJob())
+
+	assert.Nil(err)
+}
+
+func Test_Runner_Start_AcceptsRun_WhenPrefixRegexHasQuantifier(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.PREFIX] = "other, /test_[a-z]{1,3}/ , prod_*"
+
+	jobRunner, _ := newRunner(t, template)
+	_, err := jobRunner.Start(ctx, newJob())
+
+	assert.Nil(err)
+}
+
+func Test_Runner_Start_ReturnsError_WhenDenyRuleMatches(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+
+	template.Annotations[runner.INSTANCE] = "*"
+	template.Annotations[runner.INSTANCE_DENY] = "qa, prd"
+	job.Instance = "PRD"
+
+	jobRunner, _ := newRunner(t, template)
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "template annotation "+
+		"k8srun.yashkov.org/instance-deny rule \"prd\" rejects \"PRD\"")
+}
+
+func Test_Runner_Start_ReturnsError_WhenRuleIsInvalid(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+
+	template.Annotations[runner.PREFIX] = "/test_(/"
+
+	jobRunner, _ := newRunner(t, template)
+	_, err := jobRunner.Start(ctx, newJob())
+
+	assert.ErrorContains(err, "template annotation k8srun.yashkov.org/prefix: "+
+		"invalid rule \"/test_(/\"")
+}
+
+func Test_Runner_Start_AppliesOverrides_WhenTemplateAllowsThem(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+	envFile := filepath.Join(t.TempDir(), "job.env")
+
+	if err := os.WriteFile(envFile, []byte("# defaults\nA=0\nB=file\n"),
+		0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	template.Annotations[runner.OVERRIDES] = "*"
+	job.Overrides = runner.Overrides{
+		Image:          "alpine:3",
+		Env:            []string{"A=1"},
+		EnvFile:        envFile,
+		CPU:            "100m",
+		MemoryLimit:    "2Gi",
+		NodeSelector:   map[string]string{"zone": "a"},
+		Tolerations:    []string{"batch=true:NoSchedule", "spot"},
+		ServiceAccount: "batch",
+	}
+
+	jobRunner, _ := newRunner(t, template)
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+
+	pod := execution.Pod
+	container := pod.Spec.Containers[0]
+
+	assert.Equal("alpine:3", container.Image)
+	assert.Contains(container.Env, core.EnvVar{Name: "A", Value: "1"})
+	assert.Contains(container.Env, core.EnvVar{Name: "B", Value: "file"})
+	assert.Equal("100m", container.Resources.Requests.Cpu().String())
+	assert.Equal("2Gi", container.Resources.Limits.Memory().String())
+	assert.Equal(map[string]string{"zone": "a"}, pod.Spec.NodeSelector)
+	assert.Equal([]core.Toleration{
+		{Key: "batch", Operator: core.TolerationOpEqual, Value: "true",
+			Effect: core.TaintEffectNoSchedule},
+		{Key: "spot", Operator: core.TolerationOpExists},
+	}, pod.Spec.Tolerations)
+	assert.Equal("batch", pod.Spec.ServiceAccountName)
+}
+
+func Test_Runner_Start_ReturnsError_WhenOverrideIsNotAllowed(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+
+	template.Annotations[runner.OVERRIDES] = "image, env"
+	job.Overrides.CPU = "4"
+
+	jobRunner, _ := newRunner(t, template)
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "override resources is not allowed by template "+
+		"\"template\", template annotation k8srun.yashkov.org/overrides "+
+		"allows [\"image\" \"env\"]")
+}
+
+func Test_Runner_Start_ReturnsError_WhenTolerationIsInvalid(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+
+	template.Annotations[runner.OVERRIDES] = "tolerations"
+	job.Overrides.Tolerations = []string{"batch:Never"}
+
+	jobRunner, _ := newRunner(t, template)
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "invalid toleration \"batch:Never\", expected "+
+		"key[=value]:effect with effect NoSchedule, PreferNoSchedule or "+
+		"NoExecute")
+}
+
+func Test_Runner_Start_MergesTemplateOntoBase_WhenBaseIsAnnotated(t *testing.T) {
+	assert := setUp(t)
+	base := newTemplate("base")
+	template := newTemplate("template")
+
+	base.Template.Spec.Containers[0].Env = []core.EnvVar{
+		{Name: "STAGE", Value: "base"}}
+	base.Template.Spec.ServiceAccountName = "batch"
+	template.Annotations[runner.BASE] = "base"
+	template.Template.Spec.Containers[0].Image = "alpine:3"
+	template.Template.Spec.NodeSelector = map[string]string{"zone": "a"}
+
+	jobRunner, _ := newRunner(t, base, template)
+	execution, err := jobRunner.Start(ctx, newJob())
+
+	assert.Nil(err)
+
+	spec := execution.Pod.Spec
+
+	assert.Equal("alpine:3", spec.Containers[0].Image)
+	assert.Contains(spec.Containers[0].Env,
+		core.EnvVar{Name: "STAGE", Value: "base"})
+	assert.Equal("batch", spec.ServiceAccountName)
+	assert.Equal(map[string]string{"zone": "a"}, spec.NodeSelector)
+}
+
+func Test_Runner_Start_ReturnsError_WhenBaseTemplatesLoop(t *testing.T) {
+	assert := setUp(t)
+	base := newTemplate("base")
+	template := newTemplate("template")
+
+	base.Annotations[runner.BASE] = "template"
+	template.Annotations[runner.BASE] = "base"
+
+	jobRunner, _ := newRunner(t, base, template)
+	_, err := jobRunner.Start(ctx, newJob())
+
+	assert.EqualError(err, "template \"template\" inherits from itself "+
+		"through base template \"template\"")
+}
+
+func writePatch(t *testing.T, patch string) string {
+	path := filepath.Join(t.TempDir(), "patch.yaml")
+
+	if err := os.WriteFile(path, []byte(patch), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func Test_Runner_Start_AppliesPatchesInOrder_WhenTemplateAllowsThem(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+
+	template.Annotations[runner.OVERRIDES] = "patch"
+	job.PatchFiles = []string{
+		writePatch(t, "spec:\n  containers:\n  - name: job\n"+
+			"    env:\n    - name: STAGE\n      value: qa\n"),
+		writePatch(t, "- op: replace\n  path: /spec/containers/0/image\n"+
+			"  value: alpine:3\n"),
+	}
+
+	jobRunner, _ := newRunner(t, template)
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+
+	container := execution.Pod.Spec.Containers[0]
+
+	assert.Equal("alpine:3", container.Image)
+	assert.Contains(container.Env, core.EnvVar{Name: "STAGE", Value: "qa"})
+	assert.Equal([]string{"ls"}, container.Args)
+}
+
+func Test_Runner_Start_AppliesMergePatch_WhenPatchTypeIsMerge(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+
+	template.Annotations[runner.OVERRIDES] = "*"
+	job.PatchType = runner.PATCH_MERGE
+	job.PatchFiles = []string{writePatch(t,
+		"spec:\n  nodeSelector:\n    zone: b\n")}
+
+	jobRunner, _ := newRunner(t, template)
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal(map[string]string{"zone": "b"}, execution.Pod.Spec.NodeSelector)
+}
+
+func Test_Runner_Start_ReturnsError_WhenPatchIsNotAllowed(t *testing.T) {
+	assert := setUp(t)
+	job := newJob()
+
+	job.PatchFiles = []string{writePatch(t, "spec: {}\n")}
+
+	jobRunner, _ := newRunner(t, newTemplate("template"))
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "override patch is not allowed by template "+
+		"\"template\", template annotation k8srun.yashkov.org/overrides "+
+		"allows []")
+}
+
+func Test_Runner_Start_ExpandsTemplates_WhenTemplateEnablesExpansion(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+
+	template.Annotations[runner.EXPAND] = "true"
+	template.Template.Spec.Containers[0].Env = []core.EnvVar{
+		{Name: "OUTPUT", Value: "s3://out/{{.Instance | lower}}/{{.Run}}"}}
+	job.RunNumber = "1234"
+	job.Date = "2026-10-18"
+	job.Env = map[string]string{"AUTO_JOB_QUEUE": "night"}
+	job.Args = []string{"--input=/data/{{date \"20060102\" .Date}}",
+		"--queue={{.Env.AUTO_JOB_QUEUE}}"}
+
+	jobRunner, _ := newRunner(t, template)
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+
+	container := execution.Pod.Spec.Containers[0]
+
+	assert.Equal([]string{"--input=/data/20261018", "--queue=night"},
+		container.Args)
+	assert.Contains(container.Env,
+		core.EnvVar{Name: "OUTPUT", Value: "s3://out/ace/1234"})
+}
+
+func Test_Runner_Start_KeepsArgs_WhenTemplateDoesNotEnableExpansion(t *testing.T) {
+	assert := setUp(t)
+	job := newJob()
+
+	job.Args = []string{"--format={{.Name}}"}
+
+	jobRunner, _ := newRunner(t, newTemplate("template"))
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal([]string{"--format={{.Name}}"},
+		execution.Pod.Spec.Containers[0].Args)
+}
+
+func Test_Runner_Start_ReturnsError_WhenExpansionFails(t *testing.T) {
+	assert := setUp(t)
+	template := newTemplate("template")
+	job := newJob()
+
+	template.Annotations[runner.EXPAND] = "true"
+	job.Args = []string{"{{.Env.AUTO_MISSING}}"}
+
+	jobRunner, _ := newRunner(t, template)
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.ErrorContains(err, "error expanding \"{{.Env.AUTO_MISSING}}\"")
+}
+
+func Test_Runner_Start_AddsContextToLogEntries_Normally(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, newTemplate("template"))
+
+	_, err := jobRunner.Start(ctx, newJob())
+
+	assert.Nil(err)
+	assert.Equal(logrus.Fields{
+		"instance":  "ACE",
+		"job":       "TEST_JOB",
+		"template":  "template",
+		"namespace": "namespace",
+		"pod":       "test-job-00001",
+	}, logger.LastEntry().Data)
+}
+
+func Test_Runner_Start_ReturnsError_WhenEventsVerbosityIsUnknown(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, newTemplate("template"))
+	job := newJob()
+
+	job.Events = "some"
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "unsupported events verbosity \"some\", expected "+
+		"\"none\", \"warnings\" or \"all\"")
+}
@@ -0,0 +1,263 @@
+package runner
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"time"
+
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+)
+
+const (
+	KIND_POD_TEMPLATE    = "PodTemplate"
+	KIND_K8SRUN_TEMPLATE = "K8sRunTemplate"
+)
+
+const DEFAULT_START_TIMEOUT = 5 * time.Minute
+
+var K8sRunTemplateResource = schema.GroupVersionResource{
+	Group:    "k8srun.yashkov.org",
+	Version:  "v1alpha1",
+	Resource: "k8sruntemplates",
+}
+
+// K8sRunTemplate is a pod template with a structured policy for the jobs
+// allowed to run it
+type K8sRunTemplate struct {
+	meta.TypeMeta   `json:",inline"`
+	meta.ObjectMeta `json:"metadata,omitempty"`
+
+	Spec K8sRunTemplateSpec `json:"spec"`
+}
+
+type K8sRunTemplateSpec struct {
+	Template core.PodTemplateSpec `json:"template"`
+	Policy   TemplatePolicy       `json:"policy,omitempty"`
+}
+
+type TemplatePolicy struct {
+	// Instances lists the AutoSys instances allowed to run the template
+	Instances []string `json:"instances,omitempty"`
+
+	// JobNames lists the patterns of the job names allowed to run the
+	// template, each matching the whole name
+	JobNames []string `json:"jobNames,omitempty"`
+
+	Args *ArgsSchema `json:"args,omitempty"`
+
+	// Env lists the AutoSys variables the job may pass with --auto-env
+	Env []string `json:"env,omitempty"`
+
+	Timeouts *TemplateTimeouts `json:"timeouts,omitempty"`
+}
+
+type ArgsSchema struct {
+	MinCount  *int        `json:"minCount,omitempty"`
+	MaxCount  *int        `json:"maxCount,omitempty"`
+	Positions []ArgSchema `json:"positions,omitempty"`
+}
+
+// ArgSchema constrains the argument at its position, by a pattern matching
+// the whole argument or by a list of allowed values
+type ArgSchema struct {
+	Pattern string   `json:"pattern,omitempty"`
+	Enum    []string `json:"enum,omitempty"`
+}
+
+// TemplateTimeouts are the defaults for the timeouts the job doesn't set
+type TemplateTimeouts struct {
+	Start      *meta.Duration `json:"start,omitempty"`
+	Run        *meta.Duration `json:"run,omitempty"`
+	Completion *meta.Duration `json:"completion,omitempty"`
+}
+
+// Template is the pod template of a job along with its policy, which is
+// nil for plain PodTemplates
+type Template struct {
+	*core.PodTemplate
+
+	Policy *TemplatePolicy
+}
+
+func (crd *K8sRunTemplate) template() *Template {
+	return &Template{
+		PodTemplate: &core.PodTemplate{
+			ObjectMeta: crd.ObjectMeta,
+			Template:   crd.Spec.Template,
+		},
+		Policy: &crd.Spec.Policy,
+	}
+}
+
+// check validates the job against the policy of the template, falling back
+// to the instance and prefix annotations when the policy doesn't restrict
+// the instances or the job names
+func (template *Template) check(job *Job) error {
+	policy := template.Policy
+
+	if policy == nil {
+		policy = &TemplatePolicy{}
+	}
+
+	if len(policy.Instances) == 0 {
+		if err := checkAnnotation(template.PodTemplate, INSTANCE,
+			INSTANCE_DENY, strings.ToLower(job.Instance),
+			job.Instance); err != nil {
+			return err
+		}
+	} else if !containsFold(policy.Instances, job.Instance) {
+		return fmt.Errorf("instance %v is not allowed by template %q",
+			job.Instance, template.Name)
+	}
+
+	if len(policy.JobNames) == 0 {
+		if err := checkAnnotation(template.PodTemplate, PREFIX, PREFIX_DENY,
+			prefix(job.Name), job.Name); err != nil {
+			return err
+		}
+	} else if err := checkJobName(policy.JobNames, job.Name); err != nil {
+		return fmt.Errorf("job %v is not allowed by template %q: %w",
+			job.Name, template.Name, err)
+	}
+
+	if policy.Env != nil {
+		for name := range job.Env {
+			if !containsFold(policy.Env, name) {
+				return fmt.Errorf("variable %v is not allowed by template %q",
+					name, template.Name)
+			}
+		}
+	}
+
+	return nil
+}
+
+// checkArgs validates the final arguments of the main container, once
+// expanded, against the policy of the template
+func (template *Template) checkArgs(args []string) error {
+	if template.Policy == nil || template.Policy.Args == nil {
+		return nil
+	}
+
+	if problems := template.Policy.Args.validate(args); len(problems) > 0 {
+		return fmt.Errorf("invalid arguments for template %q: %v",
+			template.Name, strings.Join(problems, "; "))
+	}
+
+	return nil
+}
+
+// withDefaults returns a copy of the job with the default timeouts of the
+// template for the timeouts the job doesn't set
+func (template *Template) withDefaults(job *Job) *Job {
+	copy := *job
+	timeouts := &TemplateTimeouts{}
+
+	if template.Policy != nil && template.Policy.Timeouts != nil {
+		timeouts = template.Policy.Timeouts
+	}
+
+	if copy.StartTimeout == 0 {
+		copy.StartTimeout = DEFAULT_START_TIMEOUT
+
+		if timeouts.Start != nil {
+			copy.StartTimeout = timeouts.Start.Duration
+		}
+	}
+
+	if copy.Timeout == 0 && timeouts.Run != nil {
+		copy.Timeout = timeouts.Run.Duration
+	}
+
+	if copy.CompletionTimeout == 0 && timeouts.Completion != nil {
+		copy.CompletionTimeout = timeouts.Completion.Duration
+	}
+
+	return &copy
+}
+
+func (schema *ArgsSchema) validate(args []string) []string {
+	problems := []string{}
+
+	if schema.MinCount != nil && len(args) < *schema.MinCount {
+		problems = append(problems, fmt.Sprintf(
+			"expected at least %v arguments, got %v", *schema.MinCount,
+			len(args)))
+	}
+
+	if schema.MaxCount != nil && len(args) > *schema.MaxCount {
+		problems = append(problems, fmt.Sprintf(
+			"expected at most %v arguments, got %v", *schema.MaxCount,
+			len(args)))
+	}
+
+	for i, arg := range args {
+		if i >= len(schema.Positions) {
+			break
+		}
+
+		position := schema.Positions[i]
+
+		if len(position.Enum) > 0 && !contains(position.Enum, arg) {
+			problems = append(problems, fmt.Sprintf(
+				"argument %v %q is not one of %q", i+1, arg, position.Enum))
+		}
+
+		if position.Pattern == "" {
+			continue
+		}
+
+		re, err := regexp.Compile("^(?:" + position.Pattern + ")$")
+
+		if err != nil {
+			problems = append(problems, fmt.Sprintf(
+				"argument %v has an invalid pattern %q: %v", i+1,
+				position.Pattern, err))
+		} else if !re.MatchString(arg) {
+			problems = append(problems, fmt.Sprintf(
+				"argument %v %q does not match %q", i+1, arg,
+				position.Pattern))
+		}
+	}
+
+	return problems
+}
+
+func checkJobName(patterns []string, name string) error {
+	for _, pattern := range patterns {
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+
+		if err != nil {
+			return fmt.Errorf("invalid job name pattern %q: %w", pattern, err)
+		}
+
+		if re.MatchString(name) {
+			return nil
+		}
+	}
+
+	return fmt.Errorf("the name does not match any of %q", patterns)
+}
+
+func contains(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+
+	return false
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+
+	return false
+}
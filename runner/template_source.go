@@ -0,0 +1,216 @@
+package runner
+
+import (
+	"bytes"
+	"context"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/kubernetes"
+	"sigs.k8s.io/yaml"
+)
+
+var documentSeparator = regexp.MustCompile(`(?m)^---[ \t]*$`)
+
+// TemplateSource looks up the pod template of a job by its name
+type TemplateSource interface {
+	Get(ctx context.Context, namespace string,
+		name string) (*Template, error)
+}
+
+// podTemplateSource reads PodTemplate objects from the cluster
+type podTemplateSource struct {
+	clientset kubernetes.Interface
+}
+
+// k8sRunTemplateSource reads K8sRunTemplate custom resources from the
+// cluster
+type k8sRunTemplateSource struct {
+	client dynamic.Interface
+}
+
+// configMapSource reads PodTemplate or K8sRunTemplate manifests from the
+// keys of a ConfigMap, named after the templates with an optional .yaml or
+// .yml extension
+type configMapSource struct {
+	clientset kubernetes.Interface
+	configMap string
+}
+
+// fileSource reads PodTemplate or K8sRunTemplate manifests from a local YAML
+// file, or from the files of a local directory named after the templates
+type fileSource struct {
+	path string
+}
+
+func (runner *defaultRunner) templateSource(job *Job) (TemplateSource,
+	error) {
+	if job.TemplateFile != "" {
+		return &fileSource{path: job.TemplateFile}, nil
+	}
+
+	if job.TemplateConfigMap != "" {
+		return &configMapSource{
+			clientset: runner.clentset,
+			configMap: job.TemplateConfigMap,
+		}, nil
+	}
+
+	switch job.TemplateKind {
+	case "", KIND_POD_TEMPLATE:
+		return &podTemplateSource{clientset: runner.clentset}, nil
+	case KIND_K8SRUN_TEMPLATE:
+		client, err := Client.NewDynamicClient(runner.config)
+
+		if err != nil {
+			return nil, err
+		}
+
+		return &k8sRunTemplateSource{client: client}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported template kind %q, expected %q or %q",
+		job.TemplateKind, KIND_POD_TEMPLATE, KIND_K8SRUN_TEMPLATE)
+}
+
+func (source *podTemplateSource) Get(ctx context.Context, namespace string,
+	name string) (*Template, error) {
+	template, err := source.clientset.CoreV1().PodTemplates(namespace).
+		Get(ctx, name, meta.GetOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	return &Template{PodTemplate: template}, nil
+}
+
+func (source *k8sRunTemplateSource) Get(ctx context.Context,
+	namespace string, name string) (*Template, error) {
+	object, err := source.client.Resource(K8sRunTemplateResource).
+		Namespace(namespace).Get(ctx, name, meta.GetOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	crd := &K8sRunTemplate{}
+
+	if err := runtime.DefaultUnstructuredConverter.FromUnstructured(
+		object.Object, crd); err != nil {
+		return nil, fmt.Errorf("invalid template %q: %w", name, err)
+	}
+
+	return crd.template(), nil
+}
+
+func (source *configMapSource) Get(ctx context.Context, namespace string,
+	name string) (*Template, error) {
+	configMap, err := source.clientset.CoreV1().ConfigMaps(namespace).
+		Get(ctx, source.configMap, meta.GetOptions{})
+
+	if err != nil {
+		return nil, err
+	}
+
+	for _, key := range []string{name, name + ".yaml", name + ".yml"} {
+		if manifest, ok := configMap.Data[key]; ok {
+			return parseTemplate([]byte(manifest), namespace, name,
+				fmt.Sprintf("config map %v key %v", source.configMap, key))
+		}
+	}
+
+	return nil, fmt.Errorf("template %q not found in config map %v", name,
+		source.configMap)
+}
+
+func (source *fileSource) Get(ctx context.Context, namespace string,
+	name string) (*Template, error) {
+	path := source.path
+	info, err := os.Stat(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if info.IsDir() {
+		path = ""
+
+		for _, file := range []string{name + ".yaml", name + ".yml"} {
+			if _, err := os.Stat(filepath.Join(source.path, file)); err == nil {
+				path = filepath.Join(source.path, file)
+
+				break
+			}
+		}
+
+		if path == "" {
+			return nil, fmt.Errorf("template %q not found in %v", name,
+				source.path)
+		}
+	}
+
+	manifest, err := os.ReadFile(path)
+
+	if err != nil {
+		return nil, err
+	}
+
+	return parseTemplate(manifest, namespace, name, path)
+}
+
+// parseTemplate finds the PodTemplate or K8sRunTemplate named name among
+// the YAML documents of the manifest and places it in namespace
+func parseTemplate(manifest []byte, namespace string, name string,
+	origin string) (*Template, error) {
+	for _, document := range documentSeparator.Split(string(manifest), -1) {
+		if len(bytes.TrimSpace([]byte(document))) == 0 {
+			continue
+		}
+
+		var template *Template
+
+		kind := &meta.TypeMeta{}
+
+		if err := yaml.Unmarshal([]byte(document), kind); err != nil {
+			return nil, fmt.Errorf("invalid template in %v: %w", origin, err)
+		}
+
+		switch kind.Kind {
+		case "", KIND_POD_TEMPLATE:
+			template = &Template{PodTemplate: &core.PodTemplate{}}
+
+			if err := yaml.UnmarshalStrict([]byte(document),
+				template.PodTemplate); err != nil {
+				return nil, fmt.Errorf("invalid template in %v: %w", origin,
+					err)
+			}
+		case KIND_K8SRUN_TEMPLATE:
+			crd := &K8sRunTemplate{}
+
+			if err := yaml.UnmarshalStrict([]byte(document), crd); err != nil {
+				return nil, fmt.Errorf("invalid template in %v: %w", origin,
+					err)
+			}
+
+			template = crd.template()
+		default:
+			return nil, fmt.Errorf("invalid template in %v: unexpected kind %q",
+				origin, kind.Kind)
+		}
+
+		if template.Name == name {
+			template.Namespace = namespace
+
+			return template, nil
+		}
+	}
+
+	return nil, fmt.Errorf("template %q not found in %v", name, origin)
+}
@@ -0,0 +1,286 @@
+package runner_test
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/ayashkov/k8srun/runner"
+	"github.com/golang/mock/gomock"
+	core "k8s.io/api/core/v1"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	dynamicFake "k8s.io/client-go/dynamic/fake"
+	"sigs.k8s.io/yaml"
+)
+
+const templateManifest = `apiVersion: v1
+kind: PodTemplate
+metadata:
+  name: other
+template:
+  spec:
+    containers:
+    - name: job
+      image: busybox
+---
+apiVersion: v1
+kind: PodTemplate
+metadata:
+  name: template
+  annotations:
+    k8srun.yashkov.org/instance: ace
+    k8srun.yashkov.org/prefix: test
+template:
+  spec:
+    containers:
+    - name: job
+      image: alpine:3
+`
+
+func writeManifest(t *testing.T, name string, manifest string) string {
+	path := filepath.Join(t.TempDir(), name)
+
+	if err := os.WriteFile(path, []byte(manifest), 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	return path
+}
+
+func Test_Runner_Start_ReadsTemplate_WhenTemplateFile(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+	job := newJob()
+
+	job.TemplateFile = writeManifest(t, "templates.yaml", templateManifest)
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal("namespace", execution.Pod.Namespace)
+	assert.Equal("alpine:3", execution.Pod.Spec.Containers[0].Image)
+}
+
+func Test_Runner_Start_ReadsTemplate_WhenTemplateDirectory(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+	job := newJob()
+
+	job.TemplateFile = filepath.Dir(writeManifest(t, "template.yml",
+		templateManifest))
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal("alpine:3", execution.Pod.Spec.Containers[0].Image)
+}
+
+func Test_Runner_Start_ReturnsError_WhenTemplateIsNotInDirectory(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+	job := newJob()
+	dir := filepath.Dir(writeManifest(t, "other.yaml", templateManifest))
+
+	job.TemplateFile = dir
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "template \"template\" not found in "+dir)
+}
+
+func Test_Runner_Start_ReadsTemplate_WhenTemplateConfigMap(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t, &core.ConfigMap{
+		ObjectMeta: meta.ObjectMeta{
+			Name:      "templates",
+			Namespace: "namespace",
+		},
+		Data: map[string]string{"template.yaml": templateManifest},
+	})
+	job := newJob()
+
+	job.TemplateConfigMap = "templates"
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal("alpine:3", execution.Pod.Spec.Containers[0].Image)
+}
+
+func Test_Runner_Start_ChecksAnnotations_WhenTemplateFile(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+	job := newJob()
+
+	job.Instance = "PRD"
+	job.TemplateFile = writeManifest(t, "templates.yaml", templateManifest)
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "template annotation k8srun.yashkov.org/instance "+
+		"does not match \"prd\", allowed [\"ace\"]")
+}
+
+const crdManifest = `apiVersion: k8srun.yashkov.org/v1alpha1
+kind: K8sRunTemplate
+metadata:
+  name: template
+  namespace: namespace
+spec:
+  policy:
+    instances: [ACE, PRD]
+    jobNames: ["TEST_.*"]
+    args:
+      minCount: 1
+      maxCount: 2
+      positions:
+      - enum: [ls, cat]
+      - pattern: "[a-z/]+"
+    env: [AUTO_JOB_QUEUE]
+    timeouts:
+      start: 1m
+      run: 1h
+  template:
+    spec:
+      containers:
+      - name: job
+        image: alpine:3
+`
+
+func Test_Runner_Start_AppliesPolicyDefaults_WhenK8sRunTemplate(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+	job := newJob()
+
+	job.TemplateFile = writeManifest(t, "templates.yaml", crdManifest)
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal(time.Minute, execution.Job.StartTimeout)
+	assert.Equal(time.Hour, execution.Job.Timeout)
+	assert.Equal(int64(3610), *execution.Pod.Spec.ActiveDeadlineSeconds)
+}
+
+func Test_Runner_Start_ReportsInvalidArgs_WhenK8sRunTemplate(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t)
+	job := newJob()
+
+	job.TemplateFile = writeManifest(t, "templates.yaml", crdManifest)
+	job.Args = []string{"rm", "/tmp", "-rf"}
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "invalid arguments for template \"template\": "+
+		"expected at most 2 arguments, got 3; "+
+		"argument 1 \"rm\" is not one of [\"ls\" \"cat\"]")
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Start_ValidatesExpandedArgs_WhenK8sRunTemplate(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t)
+	job := newJob()
+
+	job.TemplateFile = writeManifest(t, "templates.yaml",
+		strings.Replace(crdManifest, "  namespace: namespace\n",
+			"  namespace: namespace\n  annotations:\n"+
+				"    k8srun.yashkov.org/expand: \"true\"\n", 1))
+	job.Env = map[string]string{"AUTO_JOB_QUEUE": "/tmp -rf"}
+	job.Args = []string{"ls", "{{.Env.AUTO_JOB_QUEUE}}"}
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "invalid arguments for template \"template\": "+
+		"argument 2 \"/tmp -rf\" does not match \"[a-z/]+\"")
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Start_ReturnsError_WhenJobNameIsNotAllowed(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+	job := newJob()
+
+	job.Name = "OTHER_JOB"
+	job.TemplateFile = writeManifest(t, "templates.yaml", crdManifest)
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err, "job OTHER_JOB is not allowed by template "+
+		"\"template\": the name does not match any of [\"TEST_.*\"]")
+}
+
+func Test_Runner_Start_ReturnsError_WhenVariableIsNotAllowed(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+	job := newJob()
+
+	job.Env = map[string]string{"AUTO_JOB_OWNER": "ops"}
+	job.TemplateFile = writeManifest(t, "templates.yaml", crdManifest)
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err,
+		"variable AUTO_JOB_OWNER is not allowed by template \"template\"")
+}
+
+func Test_Runner_Start_ReturnsError_WhenEnvOverrideIsNotAllowed(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, clientset := newRunner(t)
+	job := newJob()
+
+	job.Overrides.Env = []string{"AUTO_JOB_QUEUE=batch", "AUTO_JOB_OWNER=ops"}
+	job.TemplateFile = writeManifest(t, "templates.yaml",
+		strings.Replace(crdManifest, "  namespace: namespace\n",
+			"  namespace: namespace\n  annotations:\n"+
+				"    k8srun.yashkov.org/overrides: env\n", 1))
+
+	_, err := jobRunner.Start(ctx, job)
+
+	assert.EqualError(err,
+		"variable AUTO_JOB_OWNER is not allowed by template \"template\"")
+
+	pods, _ := clientset.CoreV1().Pods("namespace").List(ctx, meta.ListOptions{})
+
+	assert.Empty(pods.Items)
+}
+
+func Test_Runner_Start_ReadsK8sRunTemplate_WhenTemplateKind(t *testing.T) {
+	assert := setUp(t)
+	jobRunner, _ := newRunner(t)
+	job := newJob()
+	object := map[string]any{}
+
+	if err := yaml.Unmarshal([]byte(crdManifest), &object); err != nil {
+		t.Fatal(err)
+	}
+
+	mockClient.EXPECT().
+		NewDynamicClient(gomock.Any()).
+		Return(dynamicFake.NewSimpleDynamicClientWithCustomListKinds(
+			runtime.NewScheme(),
+			map[schema.GroupVersionResource]string{
+				runner.K8sRunTemplateResource: "K8sRunTemplateList",
+			},
+			&unstructured.Unstructured{Object: object}), nil)
+
+	job.TemplateKind = runner.KIND_K8SRUN_TEMPLATE
+
+	execution, err := jobRunner.Start(ctx, job)
+
+	assert.Nil(err)
+	assert.Equal("alpine:3", execution.Pod.Spec.Containers[0].Image)
+	assert.Equal(time.Hour, execution.Job.Timeout)
+}
@@ -0,0 +1,318 @@
+package runner
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ayashkov/k8srun/service"
+	"k8s.io/apimachinery/pkg/api/errors"
+	apiMeta "k8s.io/apimachinery/pkg/api/meta"
+	meta "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/watch"
+)
+
+const rewatchDelay = time.Second
+
+// trackerAttempts bounds the consecutive failed lists and watches, retried
+// with a doubling delay, before the tracker gives up
+const trackerAttempts = 5
+
+type listFunc func(ctx context.Context,
+	options meta.ListOptions) (runtime.Object, error)
+
+type watchFunc func(ctx context.Context,
+	options meta.ListOptions) (watch.Interface, error)
+
+// trackers share a lock and a change notification, so a condition can be
+// evaluated over the objects of several trackers at once
+type trackers struct {
+	mutex   sync.Mutex
+	changed chan struct{}
+}
+
+// tracker keeps an up to date copy of the objects matching its list
+// options by listing them once and then following a watch, resuming from
+// the last seen resourceVersion and re-listing when that version is too old.
+// Failed lists and watches are retried with a backoff.
+type tracker struct {
+	list    listFunc
+	watch   watchFunc
+	options meta.ListOptions
+	group   *trackers
+
+	objects map[string]runtime.Object
+	synced  bool
+	err     error
+}
+
+func newTrackers() *trackers {
+	return &trackers{changed: make(chan struct{})}
+}
+
+func (group *trackers) newTracker(list listFunc, watch watchFunc,
+	options meta.ListOptions) *tracker {
+	return &tracker{
+		list:    list,
+		watch:   watch,
+		options: options,
+		group:   group,
+		objects: map[string]runtime.Object{},
+	}
+}
+
+func (group *trackers) update(change func()) {
+	group.mutex.Lock()
+	defer group.mutex.Unlock()
+
+	change()
+	close(group.changed)
+	group.changed = make(chan struct{})
+}
+
+// wait calls condition every time objects of the members change, once all
+// of them are synced, until it reports done or returns an error
+func (group *trackers) wait(ctx context.Context,
+	condition func() (bool, error), members ...*tracker) error {
+	for {
+		group.mutex.Lock()
+
+		done, err := false, error(nil)
+		changed := group.changed
+		synced := true
+
+		for _, member := range members {
+			synced = synced && member.synced
+		}
+
+		if synced {
+			done, err = condition()
+		}
+
+		for _, member := range members {
+			if !done && err == nil {
+				err = member.err
+			}
+		}
+
+		group.mutex.Unlock()
+
+		if done || err != nil {
+			return err
+		}
+
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-changed:
+		}
+	}
+}
+
+func (tracker *tracker) run(ctx context.Context) {
+	version := ""
+	failures := 0
+
+	for {
+		var err error
+
+		if version == "" {
+			version, err = tracker.relist(ctx)
+		} else {
+			version, err = tracker.follow(ctx, version)
+		}
+
+		if err == nil {
+			failures = 0
+
+			continue
+		}
+
+		failures++
+
+		if ctx.Err() != nil || failures == trackerAttempts {
+			tracker.fail(err)
+
+			return
+		}
+
+		delay := rewatchDelay << (failures - 1)
+
+		service.Log.Warnf("error tracking %v, retrying in %v: %v",
+			tracker.selector(), delay, err)
+
+		select {
+		case <-ctx.Done():
+			tracker.fail(ctx.Err())
+
+			return
+		case <-time.After(delay):
+		}
+	}
+}
+
+func (tracker *tracker) selector() string {
+	selectors := []string{}
+
+	for _, selector := range []string{tracker.options.FieldSelector,
+		tracker.options.LabelSelector} {
+		if selector != "" {
+			selectors = append(selectors, selector)
+		}
+	}
+
+	return strings.Join(selectors, ",")
+}
+
+func (tracker *tracker) relist(ctx context.Context) (string, error) {
+	list, err := tracker.list(ctx, tracker.options)
+
+	if err != nil {
+		return "", err
+	}
+
+	items, err := apiMeta.ExtractList(list)
+
+	if err != nil {
+		return "", err
+	}
+
+	listMeta, err := apiMeta.ListAccessor(list)
+
+	if err != nil {
+		return "", err
+	}
+
+	objects := map[string]runtime.Object{}
+
+	for _, item := range items {
+		name, err := objectName(item)
+
+		if err != nil {
+			return "", err
+		}
+
+		objects[name] = item
+	}
+
+	tracker.update(func() {
+		tracker.objects = objects
+		tracker.synced = true
+	})
+
+	version := listMeta.GetResourceVersion()
+
+	if version == "" {
+		version = "0"
+	}
+
+	return version, nil
+}
+
+func (tracker *tracker) follow(ctx context.Context,
+	version string) (string, error) {
+	options := tracker.options
+
+	options.ResourceVersion = version
+	options.AllowWatchBookmarks = true
+
+	watcher, err := tracker.watch(ctx, options)
+
+	if errors.IsResourceExpired(err) || errors.IsGone(err) {
+		return "", nil
+	}
+
+	if err != nil {
+		return version, err
+	}
+
+	defer watcher.Stop()
+
+	received := false
+
+	for {
+		select {
+		case <-ctx.Done():
+			return version, ctx.Err()
+		case event, ok := <-watcher.ResultChan():
+			if !ok {
+				if !received {
+					select {
+					case <-ctx.Done():
+						return version, ctx.Err()
+					case <-time.After(rewatchDelay):
+					}
+				}
+
+				return version, nil
+			}
+
+			received = true
+
+			if event.Type == watch.Error {
+				err := errors.FromObject(event.Object)
+
+				if errors.IsResourceExpired(err) || errors.IsGone(err) {
+					service.Log.Debugf("re-listing after watch error: %v", err)
+
+					return "", nil
+				}
+
+				return version, err
+			}
+
+			name, err := objectName(event.Object)
+
+			if err != nil {
+				return version, err
+			}
+
+			if accessor, err := apiMeta.Accessor(event.Object); err == nil {
+				version = accessor.GetResourceVersion()
+			}
+
+			switch event.Type {
+			case watch.Added, watch.Modified:
+				tracker.update(func() {
+					tracker.objects[name] = event.Object
+				})
+			case watch.Deleted:
+				tracker.update(func() {
+					delete(tracker.objects, name)
+				})
+			}
+		}
+	}
+}
+
+func (tracker *tracker) update(change func()) {
+	tracker.group.update(change)
+}
+
+func (tracker *tracker) fail(err error) {
+	tracker.update(func() {
+		tracker.err = err
+	})
+}
+
+// wait calls condition with the current objects every time they change
+// until it reports done or returns an error
+func (tracker *tracker) wait(ctx context.Context,
+	condition func(objects map[string]runtime.Object) (bool, error)) error {
+	return tracker.group.wait(ctx, func() (bool, error) {
+		return condition(tracker.objects)
+	}, tracker)
+}
+
+func objectName(object runtime.Object) (string, error) {
+	accessor, err := apiMeta.Accessor(object)
+
+	if err != nil {
+		return "", fmt.Errorf("unexpected object %T: %w", object, err)
+	}
+
+	return accessor.GetName(), nil
+}
@@ -1,7 +1,113 @@
 package service
 
 import (
+	"fmt"
+	"os"
+	"sync"
+
 	"github.com/sirupsen/logrus"
 )
 
+const (
+	LOG_FORMAT_TEXT = "text"
+	LOG_FORMAT_JSON = "json"
+)
+
 var Log *logrus.Logger = logrus.New()
+
+var logFields = &fieldsHook{fields: logrus.Fields{}}
+
+// fieldsHook adds the fields of the current run to every log entry
+type fieldsHook struct {
+	mutex  sync.Mutex
+	logger *logrus.Logger
+	fields logrus.Fields
+}
+
+func (hook *fieldsHook) Levels() []logrus.Level {
+	return logrus.AllLevels
+}
+
+func (hook *fieldsHook) Fire(entry *logrus.Entry) error {
+	hook.mutex.Lock()
+	defer hook.mutex.Unlock()
+
+	for name, value := range hook.fields {
+		if _, ok := entry.Data[name]; !ok {
+			entry.Data[name] = value
+		}
+	}
+
+	return nil
+}
+
+// AddLogFields attaches the fields to all the following entries of Log,
+// empty values remove them
+func AddLogFields(fields logrus.Fields) {
+	logFields.mutex.Lock()
+	defer logFields.mutex.Unlock()
+
+	if logFields.logger != Log {
+		Log.AddHook(logFields)
+		logFields.logger = Log
+		logFields.fields = logrus.Fields{}
+	}
+
+	for name, value := range fields {
+		if value == "" {
+			delete(logFields.fields, name)
+		} else {
+			logFields.fields[name] = value
+		}
+	}
+}
+
+// ConfigureLog sets the level and the format of Log and sends it to the
+// file, when given, instead of the standard error. The returned function
+// syncs and closes the file, sending Log back to its previous output.
+func ConfigureLog(level string, format string, file string) (func() error,
+	error) {
+	parsed, err := logrus.ParseLevel(level)
+
+	if err != nil {
+		return nil, fmt.Errorf("unsupported log level %q", level)
+	}
+
+	switch format {
+	case LOG_FORMAT_TEXT:
+		Log.SetFormatter(&logrus.TextFormatter{})
+	case LOG_FORMAT_JSON:
+		Log.SetFormatter(&logrus.JSONFormatter{})
+	default:
+		return nil, fmt.Errorf("unsupported log format %q, expected %q or %q",
+			format, LOG_FORMAT_TEXT, LOG_FORMAT_JSON)
+	}
+
+	Log.SetLevel(parsed)
+
+	if file == "" {
+		return func() error { return nil }, nil
+	}
+
+	out, err := os.OpenFile(file, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+
+	if err != nil {
+		return nil, fmt.Errorf("error opening log file: %w", err)
+	}
+
+	previous := Log.Out
+
+	Log.SetOutput(out)
+
+	return func() error {
+		Log.SetOutput(previous)
+
+		if err := out.Sync(); err != nil {
+			out.Close()
+
+			return fmt.Errorf("error syncing log file: %w", err)
+		}
+
+		return out.Close()
+	}, nil
+}
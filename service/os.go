@@ -1,14 +1,19 @@
 package service
 
 import (
+	"context"
 	"io"
 	"os"
+	"os/signal"
 )
 
 type OsServices interface {
 	Args() []string
 	Exit(code int)
 	Getenv(key string) string
+	Hostname() (string, error)
+	NotifyContext(parent context.Context,
+		signals ...os.Signal) (context.Context, context.CancelFunc)
 	Stderr() io.Writer
 	Stdin() io.Reader
 	Stdout() io.Writer
@@ -30,6 +35,15 @@ func (defaultOsServices) Getenv(key string) string {
 	return os.Getenv(key)
 }
 
+func (defaultOsServices) Hostname() (string, error) {
+	return os.Hostname()
+}
+
+func (defaultOsServices) NotifyContext(parent context.Context,
+	signals ...os.Signal) (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(parent, signals...)
+}
+
 func (defaultOsServices) Stderr() io.Writer {
 	return os.Stderr
 }